@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Bump it whenever a field of BasicsRecord changes meaning. Records of other versions are ignored and loaded again from Google Drive.
+const BASICS_RECORD_VERSION = 1
+
+// Everything DriveGetBasics knows about a file. It is saved as a single "Basics:<id>" key, so it is always read and written as a whole.
+type BasicsRecord struct {
+	Version     int
+	Name        string
+	MimeType    string
+	MD5         string   `json:",omitempty"`
+	Revision    string   `json:",omitempty"`
+	Parents     []string `json:",omitempty"`
+	Size        uint64
+	Atime       uint64
+	Ctime       uint64
+	Mtime       uint64
+	Atimensec   uint32
+	Ctimensec   uint32
+	Mtimensec   uint32
+	RefreshTime int64
+	Ret         fuse.Status
+}
+
+func (rec BasicsRecord) IsDir() bool {
+	return rec.MimeType == MimeTypeGoogleFolder
+}
+
+func basics_key(google_id string) []byte {
+	return []byte("Basics:" + google_id)
+}
+
+func basics_decode(byt []byte) (rec BasicsRecord, found bool) {
+	if byt == nil {
+		return BasicsRecord{}, false
+	}
+	if err := json.Unmarshal(byt, &rec); err != nil || rec.Version != BASICS_RECORD_VERSION {
+		return BasicsRecord{}, false
+	}
+	return rec, true
+}
+
+func BasicsGet(google_id string) (rec BasicsRecord, found bool) {
+	err := Store.View(func(tx StoreTx) error {
+		rec, found = basics_decode(tx.Get(StdBucket, basics_key(google_id)))
+		return nil
+	})
+	if err != nil {
+		Log.PanicF("Failed to read basics of %s from database: %v", google_id, err)
+	}
+	return
+}
+
+// Tells whether we have the name (and everything else) of google_id, even if it could not be refreshed lately.
+func BasicsKnown(google_id string) bool {
+	rec, found := BasicsGet(google_id)
+	return found && rec.Name != ""
+}
+
+// Changes the record of google_id in a single transaction. fn gets an empty record if there is none yet.
+func BasicsUpdate(google_id string, fn func(rec *BasicsRecord)) {
+	err := Store.Update(func(tx StoreTx) error {
+		rec, _ := basics_decode(tx.Get(StdBucket, basics_key(google_id)))
+		fn(&rec)
+		rec.Version = BASICS_RECORD_VERSION
+		byt, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return tx.Put(StdBucket, basics_key(google_id), byt)
+	})
+	if err != nil {
+		Log.PanicF("Failed to save basics of %s onto database: %v", google_id, err)
+	}
+}
+
+// Copies the size and modification time of the local copy of google_id onto its record, so they are right before the upload reaches Google Drive.
+func BasicsUpdateLocal(google_id string) {
+	// Files that were removed meanwhile are left alone
+	if _, found := BasicsGet(google_id); !found {
+		return
+	}
+	info, err := os.Stat(CacheDir + google_id)
+	if err != nil {
+		Log.DebugF("BasicsUpdateLocal: Unable to stat %s: %v", google_id, err)
+		return
+	}
+	mtime := info.ModTime()
+	BasicsUpdate(google_id, func(rec *BasicsRecord) {
+		rec.Size = uint64(info.Size())
+		rec.Mtime = uint64(mtime.Unix())
+		rec.Mtimensec = uint32(mtime.Nanosecond())
+	})
+	NotifyFile(google_id)
+}
+
+func BasicsForget(google_id string) {
+	CDel("Basics:"+google_id, "Basics:"+google_id+":!working")
+}
+
+// Makes every record be loaded again before it is used.
+func BasicsExpireAll() int {
+	count := 0
+	err := Store.Update(func(tx StoreTx) error {
+		recs := make(map[string]BasicsRecord)
+		err := tx.ForEach(StdBucket, []byte("Basics:"), func(k, v []byte) error {
+			if rec, found := basics_decode(v); found && !strings.Contains(string(k), ":!") {
+				recs[string(k)] = rec
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, rec := range recs {
+			rec.RefreshTime = 0
+			byt, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(StdBucket, []byte(key), byt); err != nil {
+				return err
+			}
+		}
+		count = len(recs)
+		return nil
+	})
+	if err != nil {
+		Log.PanicF("Failed to expire basics: %v", err)
+	}
+	return count
+}
+
+// Converts the "BasicAttr:<id>:<field>" keys older versions of MegaDrive used into records.
+func BasicsMigrate() {
+	old := make(map[string]map[string][]byte)
+	err := Store.Update(func(tx StoreTx) error {
+		err := tx.ForEach(StdBucket, []byte("BasicAttr:"), func(k, v []byte) error {
+			parts := strings.SplitN(strings.TrimPrefix(string(k), "BasicAttr:"), ":", 2)
+			if len(parts) != 2 {
+				return nil
+			}
+			if old[parts[0]] == nil {
+				old[parts[0]] = make(map[string][]byte)
+			}
+			old[parts[0]][parts[1]] = append([]byte{}, v...)
+			return nil
+		})
+		if err != nil || len(old) == 0 {
+			return err
+		}
+
+		for google_id, fields := range old {
+			rec := BasicsRecord{
+				Version:   BASICS_RECORD_VERSION,
+				Name:      string(fields["Name"]),
+				MimeType:  string(fields["MimeType"]),
+				MD5:       string(fields["MD5"]),
+				Revision:  string(fields["Revision"]),
+				Size:      basics_migrate_uint(fields["Size"]),
+				Atime:     basics_migrate_uint(fields["Atime"]),
+				Ctime:     basics_migrate_uint(fields["Ctime"]),
+				Mtime:     basics_migrate_uint(fields["Mtime"]),
+				Atimensec: uint32(basics_migrate_uint(fields["Atimensec"])),
+				Ctimensec: uint32(basics_migrate_uint(fields["Ctimensec"])),
+				Mtimensec: uint32(basics_migrate_uint(fields["Mtimensec"])),
+				Ret:       fuse.EIO,
+			}
+			json.Unmarshal(fields["Parents"], &rec.Parents)
+			json.Unmarshal(fields["!ret"], &rec.Ret)
+			// Everything is checked again once, just in case
+			byt, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(StdBucket, basics_key(google_id), byt); err != nil {
+				return err
+			}
+			for field := range fields {
+				if err := tx.Delete(StdBucket, []byte("BasicAttr:"+google_id+":"+field)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Log.FatalF("Failed to migrate the cache: %v", err)
+	}
+	if len(old) > 0 {
+		Log.NoticeF("Migrated %d files to version %d of the cache", len(old), BASICS_RECORD_VERSION)
+	}
+}
+
+func basics_migrate_uint(byt []byte) uint64 {
+	v, _ := strconv.ParseUint(string(byt), 10, 64)
+	return v
+}
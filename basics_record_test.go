@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Keys as they were saved before BasicsRecord existed.
+func basics_put_old(google_id string, fields map[string]interface{}) {
+	for field, v := range fields {
+		CSet("BasicAttr:"+google_id+":"+field, v)
+	}
+}
+
+func TestBasicsMigrate(t *testing.T) {
+	test_store_reset()
+	basics_put_old("a", map[string]interface{}{
+		"Name":      "notes.txt",
+		"MimeType":  "text/plain",
+		"MD5":       "0123456789abcdef0123456789abcdef",
+		"Revision":  "rev",
+		"Parents":   []string{"root"},
+		"Size":      42,
+		"Mtime":     1582230020,
+		"Mtimensec": 5,
+		"Ctime":     1582230000,
+		"!ret":      fuse.OK,
+	})
+	basics_put_old("folder", map[string]interface{}{
+		"Name":     "folder",
+		"MimeType": MimeTypeGoogleFolder,
+		"!ret":     fuse.ENOENT,
+	})
+	CSet("BasicAttr:junk", "no field")
+	BasicsMigrate()
+
+	rec, found := BasicsGet("a")
+	if !found {
+		t.Fatalf("a was not migrated")
+	}
+	expected := BasicsRecord{
+		Version:   BASICS_RECORD_VERSION,
+		Name:      "notes.txt",
+		MimeType:  "text/plain",
+		MD5:       "0123456789abcdef0123456789abcdef",
+		Revision:  "rev",
+		Parents:   []string{"root"},
+		Size:      42,
+		Mtime:     1582230020,
+		Mtimensec: 5,
+		Ctime:     1582230000,
+		Ret:       fuse.OK,
+	}
+	// RefreshTime is zero, so it is checked again once
+	if !reflect.DeepEqual(rec, expected) {
+		t.Errorf("Got %+v instead of %+v", rec, expected)
+	}
+	if rec, _ := BasicsGet("folder"); !rec.IsDir() || rec.Ret != fuse.ENOENT {
+		t.Errorf("Got %+v for folder", rec)
+	}
+	if keys := CKeysPrefix("BasicAttr:a:"); len(keys) != 0 {
+		t.Errorf("%v were left behind", keys)
+	}
+
+	// Running it again changes nothing
+	BasicsUpdate("a", func(rec *BasicsRecord) { rec.Size = 43 })
+	BasicsMigrate()
+	if rec, _ := BasicsGet("a"); rec.Size != 43 {
+		t.Errorf("Got %+v after migrating twice", rec)
+	}
+
+	// Records of other versions are loaded again
+	CSet("Basics:old", BasicsRecord{Version: BASICS_RECORD_VERSION - 1, Name: "old"})
+	if rec, found := BasicsGet("old"); found {
+		t.Errorf("Got %+v for a record of another version", rec)
+	}
+}
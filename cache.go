@@ -10,51 +10,57 @@ import (
 var StdBucket = []byte("generic")
 
 func CFound(keys ...string) bool {
-	tx, err := DB.Begin(false)
-	if err != nil {
-		Log.PanicF("Failed to create new transaction in database: %v", err)
-	}
-	defer tx.Rollback()
+	return CFoundPrefix("", keys...)
+}
 
-	b := tx.Bucket(StdBucket)
-	for _, key := range keys {
-		if v := b.Get([]byte(key)); v == nil {
-			Log.DebugNF(1, "Cache MISS for %s in %+v", key, keys)
-			return false
+func CFoundPrefix(prefix string, keys ...string) bool {
+	missing := ""
+	err := Store.View(func(tx StoreTx) error {
+		for _, key := range keys {
+			if v := tx.Get(StdBucket, []byte(prefix+key)); v == nil {
+				missing = prefix + key
+				return nil
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		Log.PanicF("Failed to read from database: %v", err)
+	}
+	if missing != "" {
+		Log.DebugNF(2, "Cache MISS for %s in %+v", missing, keys)
+		return false
 	}
 	return true
 }
 
-func CFoundPrefix(prefix string, keys ...string) bool {
-	tx, err := DB.Begin(false)
+// Returns every key starting with prefix.
+func CKeysPrefix(prefix string) []string {
+	keys := make([]string, 0)
+	err := Store.View(func(tx StoreTx) error {
+		return tx.ForEach(StdBucket, []byte(prefix), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
 	if err != nil {
-		Log.PanicF("Failed to create new transaction in database: %v", err)
+		Log.PanicF("Failed to read from database: %v", err)
 	}
-	defer tx.Rollback()
-
-	b := tx.Bucket(StdBucket)
-	for _, key := range keys {
-		key = prefix + key
-		if v := b.Get([]byte(key)); v == nil {
-			Log.DebugNF(1, "Cache MISS for %s in %+v", key, keys)
-			return false
-		}
-	}
-	return true
+	return keys
 }
 
 func CGet_bytes(key string) []byte {
-	tx, err := DB.Begin(false)
+	var ret []byte
+	err := Store.View(func(tx StoreTx) error {
+		if byt := tx.Get(StdBucket, []byte(key)); byt != nil {
+			ret = make([]byte, len(byt))
+			copy(ret, byt)
+		}
+		return nil
+	})
 	if err != nil {
-		Log.PanicF("Failed to create new transaction in database: %v", err)
+		Log.PanicF("Failed to read %s from database: %v", key, err)
 	}
-	defer tx.Rollback()
-
-	b := tx.Bucket(StdBucket)
-	byt := b.Get([]byte(key))
-	ret := make([]byte, len(byt))
-	copy(ret, byt)
 	return ret
 }
 
@@ -136,18 +142,12 @@ func CGetDef(key string, dst interface{}, def interface{}) error {
 }
 
 func CSet_bytes(key string, val []byte) {
-	tx, err := DB.Begin(true)
-	if err != nil {
-		Log.PanicF("Failed to create new transaction in database: %v", err)
-	}
-	defer tx.Rollback()
-
-	b := tx.Bucket(StdBucket)
-	err = b.Put([]byte(key), val)
+	err := Store.Update(func(tx StoreTx) error {
+		return tx.Put(StdBucket, []byte(key), val)
+	})
 	if err != nil {
 		Log.PanicF("Failed to save %s onto database: %v", key, err)
 	}
-	tx.Commit()
 }
 
 func CSet(key string, val interface{}) {
@@ -165,6 +165,74 @@ func CSet(key string, val interface{}) {
 	}
 }
 
+// Saves every key in set and deletes every key in del in a single transaction.
+func CApply(set map[string]interface{}, del ...string) {
+	err := Store.Update(func(tx StoreTx) error {
+		for _, key := range del {
+			if err := tx.Delete(StdBucket, []byte(key)); err != nil {
+				return err
+			}
+		}
+		for key, val := range set {
+			var byt []byte
+			if v, ok := val.(string); ok {
+				byt = []byte(v)
+			} else if v, ok := val.([]byte); ok {
+				byt = v
+			} else {
+				var err error
+				if byt, err = json.Marshal(val); err != nil {
+					Log.PanicF("Failed to encode json: %v", err)
+				}
+			}
+			if err := tx.Put(StdBucket, []byte(key), byt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Log.PanicF("Failed to save changes onto database: %v", err)
+	}
+}
+
+func CDel(keys ...string) {
+	err := Store.Update(func(tx StoreTx) error {
+		for _, key := range keys {
+			if err := tx.Delete(StdBucket, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Log.PanicF("Failed to delete %+v from database: %v", keys, err)
+	}
+}
+
+// Deletes every key starting with prefix.
+func CDelPrefix(prefix string) {
+	err := Store.Update(func(tx StoreTx) error {
+		keys := make([][]byte, 0)
+		err := tx.ForEach(StdBucket, []byte(prefix), func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.Delete(StdBucket, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Log.PanicF("Failed to delete %s* from database: %v", prefix, err)
+	}
+}
+
 func CGetRWMutex(key string) *sync.RWMutex {
 	v, f := MemCache.Get(key)
 	if f {
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const CACHE_EVICT_INTERVAL = 1 * time.Minute
+
+// Access times are only saved when they move by more than this, so reads do not turn into database writes.
+const CACHE_ATIME_RESOLUTION = 1 * time.Minute
+
+// Limits for the files downloaded to CacheDir. Zero means unlimited.
+var CacheMaxBytes int64
+var CacheMaxFiles int
+
+// Files being used by an MDNode or MDFile are never evicted. This counts how many of them have each id open.
+var CacheOpenIds = make(map[string]int)
+var CacheOpenIdsMux = new(sync.Mutex)
+var ChCacheEvict = make(chan bool, 1)
+
+func CacheOpen(google_id string) {
+	CacheOpenIdsMux.Lock()
+	defer CacheOpenIdsMux.Unlock()
+	CacheOpenIds[google_id]++
+}
+
+func CacheClose(google_id string) {
+	CacheOpenIdsMux.Lock()
+	defer CacheOpenIdsMux.Unlock()
+	CacheOpenIds[google_id]--
+	if CacheOpenIds[google_id] <= 0 {
+		delete(CacheOpenIds, google_id)
+	}
+}
+
+func CacheIsOpen(google_id string) bool {
+	CacheOpenIdsMux.Lock()
+	defer CacheOpenIdsMux.Unlock()
+	return CacheOpenIds[google_id] > 0
+}
+
+// Records that the cached copy of google_id was just used.
+func CacheTouch(google_id string) {
+	now := time.Now().Unix()
+	if now-CGetDef_int64("Read:"+google_id+":!Atime", 0) >= int64(CACHE_ATIME_RESOLUTION/time.Second) {
+		CSet("Read:"+google_id+":!Atime", now)
+	}
+}
+
+// Asks CacheEvictConsumer to check the limits soon. Nothing happens if it was already asked to.
+func CacheEvictRequest() {
+	select {
+	case ChCacheEvict <- true:
+	default:
+	}
+}
+
+func CacheEvictConsumer() {
+	Log.Notice("CacheEvictConsumer: Started")
+	for !Unmounting() {
+		select {
+		case <-ChCacheEvict:
+		case <-time.After(CACHE_EVICT_INTERVAL):
+		}
+		CacheEvict()
+	}
+}
+
+// Partially downloaded files are sparse, so count what they really use on disk.
+func cache_disk_usage(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+type cache_entry struct {
+	google_id string
+	size      int64
+	atime     int64
+}
+
+// Removes the least recently used files from CacheDir until it is within CacheMaxBytes and CacheMaxFiles. Pinned, open and not yet uploaded files are never removed.
+func CacheEvict() {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+		}
+	}()
+
+	if CacheMaxBytes <= 0 && CacheMaxFiles <= 0 {
+		return
+	}
+	_start := time.Now()
+	defer PrintCallDuration("CacheEvict", &_start)
+
+	infos, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		Log.ErrorF("Unable to list %s: %v", CacheDir, err)
+		return
+	}
+
+	// Find what is in the cache
+	var total_bytes int64
+	total_files := 0
+	candidates := make([]cache_entry, 0)
+	for _, info := range infos {
+		google_id := info.Name()
+		if !info.Mode().IsRegular() || (!CFound("Read:"+google_id+":!ret") && !CFound("Block:"+google_id+":!bitmap")) {
+			continue
+		}
+		size := cache_disk_usage(info)
+		total_bytes += size
+		total_files++
+		if PinIsKept(google_id) || CacheIsOpen(google_id) || JournalPending(google_id) {
+			continue
+		}
+		atime := CGetDef_int64("Read:"+google_id+":!Atime", info.ModTime().Unix())
+		candidates = append(candidates, cache_entry{google_id, size, atime})
+	}
+
+	// Oldest first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].atime < candidates[j].atime
+	})
+	for _, entry := range candidates {
+		over_bytes := CacheMaxBytes > 0 && total_bytes > CacheMaxBytes
+		over_files := CacheMaxFiles > 0 && total_files > CacheMaxFiles
+		if !over_bytes && !over_files {
+			break
+		}
+		if !cache_evict(entry.google_id) {
+			continue
+		}
+		total_bytes -= entry.size
+		total_files--
+		Log.InfoF("CacheEvict: Evicted %s (%d bytes)", entry.google_id, entry.size)
+	}
+}
+
+// Removes the cached copy of google_id unless it started being used meanwhile. It takes the lock DriveReadRange holds while it writes blocks, and drops the bitmap before the file so no block is ever believed to be there when it is not.
+func cache_evict(google_id string) bool {
+	CLock("Block:" + google_id + ":!mux")
+	defer CUnlock("Block:" + google_id + ":!mux")
+	if PinIsKept(google_id) || CacheIsOpen(google_id) || JournalPending(google_id) {
+		return false
+	}
+	CDelPrefix("Block:" + google_id + ":")
+	if err := os.Remove(CacheDir + google_id); err != nil && !os.IsNotExist(err) {
+		Log.WarningF("Failed to evict %s: %v", google_id, err)
+		return false
+	}
+	CDelPrefix("Read:" + google_id + ":")
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Sizes are whole disk blocks, as eviction counts what files use on disk.
+const CACHE_LRU_TEST_SIZE = 4096
+
+// Puts a downloaded copy of google_id on CacheDir, last read at atime.
+func cache_lru_put(t *testing.T, google_id string, atime int64) {
+	if err := ioutil.WriteFile(CacheDir+google_id, make([]byte, CACHE_LRU_TEST_SIZE), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	CSet("Read:"+google_id+":!ret", fuse.OK)
+	CSet("Read:"+google_id+":!Atime", atime)
+}
+
+func cache_lru_cached(google_id string) bool {
+	_, err := os.Stat(CacheDir + google_id)
+	return err == nil && CFound("Read:"+google_id+":!ret")
+}
+
+// Sets the limits for the rest of the test.
+func cache_lru_limits(t *testing.T, max_bytes int64, max_files int) {
+	old_bytes, old_files := CacheMaxBytes, CacheMaxFiles
+	CacheMaxBytes, CacheMaxFiles = max_bytes, max_files
+	t.Cleanup(func() { CacheMaxBytes, CacheMaxFiles = old_bytes, old_files })
+}
+
+func TestCacheEvictLimits(t *testing.T) {
+	fake_drive_env(t)
+	for i, google_id := range []string{"a", "b", "c", "d"} {
+		cache_lru_put(t, google_id, int64(1000+i))
+	}
+	cache_lru_limits(t, 0, 3)
+	CacheEvict()
+	if cache_lru_cached("a") || !cache_lru_cached("b") {
+		t.Fatalf("Only a, the oldest, should be gone")
+	}
+	cache_lru_limits(t, 2*CACHE_LRU_TEST_SIZE, 0)
+	CacheEvict()
+	if cache_lru_cached("b") || !cache_lru_cached("c") || !cache_lru_cached("d") {
+		t.Fatalf("Only b should be gone")
+	}
+
+	// Pinned, open and not yet uploaded files stay, however old
+	for i, google_id := range []string{"pinned", "open", "pending"} {
+		cache_lru_put(t, google_id, int64(i))
+	}
+	PinSet("pinned", true)
+	CacheOpen("open")
+	defer CacheClose("open")
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "pending"})
+	cache_lru_limits(t, 0, 1)
+	CacheEvict()
+	for _, google_id := range []string{"pinned", "open", "pending"} {
+		if !cache_lru_cached(google_id) {
+			t.Errorf("%s was evicted", google_id)
+		}
+	}
+	if cache_lru_cached("c") || cache_lru_cached("d") {
+		t.Errorf("c and d are still there")
+	}
+}
+
+// A file must not be evicted while DriveReadRange writes its blocks.
+func TestCacheEvictBlocks(t *testing.T) {
+	fake_drive_env(t)
+	cache_lru_put(t, "a", 1000)
+	CDel("Read:a:!ret")
+	CSet("Block:a:!bitmap", []byte{1})
+	cache_lru_limits(t, 1, 0)
+
+	CLock("Block:a:!mux")
+	done := make(chan bool)
+	go func() {
+		CacheEvict()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(CacheDir + "a"); err != nil || !CFound("Block:a:!bitmap") {
+		t.Errorf("a was evicted while its blocks were being written (%v)", err)
+	}
+	CUnlock("Block:a:!mux")
+	<-done
+	if _, err := os.Stat(CacheDir + "a"); !os.IsNotExist(err) || CFound("Block:a:!bitmap") {
+		t.Errorf("a is still there (%v)", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Setting this extended attribute checks the cached copy of a file (or, for folders, of every cached file inside them) against its MD5.
+const VERIFY_XATTR = "user.megadrive.verify"
+
+func file_md5(path string) (string, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Checks the cached copy of google_id against the MD5 it was downloaded with and throws it away if they differ, so it is downloaded again. Returns false only if the copy was thrown away.
+func CacheVerify(google_id string) bool {
+	CLock("Block:" + google_id + ":!mux")
+	defer CUnlock("Block:" + google_id + ":!mux")
+
+	// Exported files have no MD5 and local changes are not expected to match
+	cloud_md5 := CGet_str("Read:" + google_id + ":!MD5")
+	var status fuse.Status
+	CGet("Read:"+google_id+":!ret", &status)
+	if cloud_md5 == "" || status != fuse.OK || JournalPending(google_id) || CacheIsOpen(google_id) {
+		return true
+	}
+	sum, err := file_md5(CacheDir + google_id)
+	if err == nil && sum == cloud_md5 {
+		return true
+	}
+	if err != nil {
+		Log.WarningF("CacheVerify: Unable to check %s: %v", google_id, err)
+	} else {
+		Log.WarningF("CacheVerify: %s has MD5 %s instead of %s", google_id, sum, cloud_md5)
+	}
+	if err := os.Remove(CacheDir + google_id); err != nil && !os.IsNotExist(err) {
+		Log.WarningF("Failed to remove cache file for %s: %v", google_id, err)
+	}
+	CDelPrefix("Read:" + google_id + ":")
+	return false
+}
+
+// Runs CacheVerify on every file on CacheDir.
+func CacheVerifyAll() {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("CacheVerifyAll", &_start)
+
+	infos, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		Log.ErrorF("Unable to list %s: %v", CacheDir, err)
+		return
+	}
+	bad := 0
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !CacheVerify(info.Name()) {
+			bad++
+		}
+	}
+	Log.InfoF("CacheVerifyAll: Threw away %d bad files", bad)
+}
+
+// Runs CacheVerify on every file inside google_id (and its subfolders) that has a cached listing.
+func CacheVerifyTree(google_id string) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("CacheVerifyTree", &_start)
+
+	seen := make(map[string]bool)
+	queue := []string{google_id}
+	bad := 0
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		var dirs []fuse.DirEntry
+		CGet("OpenDir:"+id, &dirs)
+		for _, entry := range dirs {
+			child_id := CGet_str("Lookup:" + entry.Name + ":in:" + id + ":id")
+			if child_id == "" {
+				continue
+			}
+			if entry.Mode&fuse.S_IFDIR != 0 {
+				queue = append(queue, child_id)
+			} else if !CacheVerify(child_id) {
+				bad++
+			}
+		}
+	}
+	Log.InfoF("CacheVerifyTree: Threw away %d bad files inside %s", bad, google_id)
+}
+
+// Implements "MegaDrive verify PATH...". It works on an already mounted MegaDrive by setting the verify extended attribute.
+func VerifyCommand(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage:\n  MegaDrive verify PATH...\n")
+		return 2
+	}
+	ret := 0
+	for _, path := range paths {
+		if err := syscall.Setxattr(path, VERIFY_XATTR, []byte("1"), 0); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to verify %s: %v\n", path, err)
+			ret = 1
+		}
+	}
+	return ret
+}
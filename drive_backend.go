@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Everything MegaDrive asks Google Drive goes through a DriveBackend. Consumers get theirs when they are started and MDNodes get it from their parent, so a fake one can be used instead of the real thing.
+type DriveBackend interface {
+	// Returns the metadata (DriveFileFields) of google_id. "root" names the root folder.
+	Get(google_id string) (*drive.File, error)
+	// Returns every file inside parent_id that was not trashed.
+	List(parent_id string) ([]*drive.File, error)
+	// Returns the content of google_id. If end >= 0 only the bytes [start, end] are asked for and partial tells whether Google Drive honoured that.
+	Download(google_id string, start, end int64) (body io.ReadCloser, partial bool, err error)
+	// Returns the content of a Google-native file converted to mime_type.
+	Export(google_id, mime_type string) (io.ReadCloser, error)
+	// Creates file with the given content (none for folders). file.Id may come from GenerateIds.
+	Create(file *drive.File, media io.Reader) (*drive.File, error)
+	// Changes the name and parents of google_id and, if media is not nil, its content.
+	Update(google_id string, file *drive.File, media io.Reader, add_parent, remove_parent string) (*drive.File, error)
+	// Moves google_id to the trash or deletes it for good.
+	Delete(google_id string, permanently bool) error
+	// Returns ids that can be used with Create.
+	GenerateIds(count int) ([]string, error)
+	// Returns the page token of the next change.
+	StartPageToken() (string, error)
+	// Returns the changes after page_token. Either next_token (more changes) or new_start_token (no more changes for now) is set.
+	Changes(page_token string) (changes []*drive.Change, next_token, new_start_token string, err error)
+}
+
+// The DriveBackend that talks to the real Google Drive.
+type DriveServiceBackend struct {
+	srv *drive.Service
+}
+
+func NewDriveServiceBackend(srv *drive.Service) *DriveServiceBackend {
+	return &DriveServiceBackend{srv: srv}
+}
+
+func (b *DriveServiceBackend) Get(google_id string) (*drive.File, error) {
+	return b.srv.Files.Get(google_id).Fields(DriveFileFields).Do()
+}
+
+func (b *DriveServiceBackend) List(parent_id string) ([]*drive.File, error) {
+	// Only return once every page was loaded
+	files := make([]*drive.File, 0)
+	page_token := ""
+	for {
+		call := b.srv.Files.List().
+			PageSize(OPENDIR_PAGE_SIZE).
+			Fields("nextPageToken, files(" + DriveFileFields + ")").
+			Q(escape("'?' in parents and trashed = false", parent_id))
+		if page_token != "" {
+			call = call.PageToken(page_token)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, r.Files...)
+		if r.NextPageToken == "" {
+			return files, nil
+		}
+		page_token = r.NextPageToken
+		Log.DebugF("DriveServiceBackend: %s has more than %d files, loading next page", parent_id, len(files))
+	}
+}
+
+func (b *DriveServiceBackend) Download(google_id string, start, end int64) (io.ReadCloser, bool, error) {
+	call := b.srv.Files.Get(google_id)
+	if end >= 0 {
+		call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	r, err := call.Download()
+	if err != nil {
+		return nil, false, err
+	}
+	return r.Body, r.StatusCode == http.StatusPartialContent, nil
+}
+
+func (b *DriveServiceBackend) Export(google_id, mime_type string) (io.ReadCloser, error) {
+	r, err := b.srv.Files.Export(google_id, mime_type).Download()
+	if err != nil {
+		return nil, err
+	}
+	return r.Body, nil
+}
+
+func (b *DriveServiceBackend) Create(file *drive.File, media io.Reader) (*drive.File, error) {
+	call := b.srv.Files.Create(file)
+	if media != nil {
+		call = call.Media(media)
+	}
+	return call.Fields(DriveFileFields).Do()
+}
+
+func (b *DriveServiceBackend) Update(google_id string, file *drive.File, media io.Reader, add_parent, remove_parent string) (*drive.File, error) {
+	call := b.srv.Files.Update(google_id, file)
+	if media != nil {
+		call = call.Media(media)
+	}
+	if add_parent != "" {
+		call = call.AddParents(add_parent)
+	}
+	if remove_parent != "" {
+		call = call.RemoveParents(remove_parent)
+	}
+	return call.Fields(DriveFileFields).Do()
+}
+
+func (b *DriveServiceBackend) Delete(google_id string, permanently bool) error {
+	if permanently {
+		return b.srv.Files.Delete(google_id).Do()
+	}
+	_, err := b.srv.Files.Update(google_id, &drive.File{Trashed: true}).Fields("id").Do()
+	return err
+}
+
+func (b *DriveServiceBackend) GenerateIds(count int) ([]string, error) {
+	r, err := b.srv.Files.GenerateIds().Count(int64(count)).Space("drive").Do()
+	if err != nil {
+		return nil, err
+	}
+	return r.Ids, nil
+}
+
+func (b *DriveServiceBackend) StartPageToken() (string, error) {
+	r, err := b.srv.Changes.GetStartPageToken().Do()
+	if err != nil {
+		return "", err
+	}
+	return r.StartPageToken, nil
+}
+
+func (b *DriveServiceBackend) Changes(page_token string) ([]*drive.Change, string, string, error) {
+	r, err := b.srv.Changes.List(page_token).
+		PageSize(CHANGES_PAGE_SIZE).
+		IncludeRemoved(true).
+		Spaces("drive").
+		Fields("nextPageToken, newStartPageToken, changes(fileId, removed, file(" + DriveFileFields + ", trashed))").
+		Do()
+	if err != nil {
+		return nil, "", "", err
+	}
+	return r.Changes, r.NextPageToken, r.NewStartPageToken, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// A DriveBackend that keeps a whole Google Drive in memory, so everything above it can be exercised without network access. Ids are handed out in order and Now can be replaced, so the same calls always give the same answers.
+type FakeDriveBackend struct {
+	// Used for modifiedTime and createdTime
+	Now     func() time.Time
+	files   map[string]*fake_drive_file
+	changes []*drive.Change
+	root_id string
+	next_id int
+	mux     *sync.Mutex
+}
+
+type fake_drive_file struct {
+	file     drive.File
+	content  []byte
+	revision int
+}
+
+func NewFakeDriveBackend() *FakeDriveBackend {
+	b := &FakeDriveBackend{
+		Now:   time.Now,
+		files: make(map[string]*fake_drive_file),
+		mux:   new(sync.Mutex),
+	}
+	b.root_id = b.new_id()
+	now := b.Now().UTC().Format(time.RFC3339)
+	b.files[b.root_id] = &fake_drive_file{file: drive.File{
+		Id:           b.root_id,
+		Name:         "My Drive",
+		MimeType:     MimeTypeGoogleFolder,
+		CreatedTime:  now,
+		ModifiedTime: now,
+	}}
+	return b
+}
+
+// Returns the real id of "root".
+func (b *FakeDriveBackend) RootId() string {
+	return b.root_id
+}
+
+// Adds a file (or a folder, if mime_type is MimeTypeGoogleFolder) to parent_id and returns it. Meant for setting up a fake Drive before it is used.
+func (b *FakeDriveBackend) Put(parent_id, name, mime_type string, content []byte) *drive.File {
+	file, err := b.Create(&drive.File{Name: name, MimeType: mime_type, Parents: []string{parent_id}}, bytes.NewReader(content))
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+func (b *FakeDriveBackend) Get(google_id string) (*drive.File, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	f, err := b.lookup(google_id)
+	if err != nil {
+		return nil, err
+	}
+	return f.copy(), nil
+}
+
+func (b *FakeDriveBackend) List(parent_id string) ([]*drive.File, error) {
+	return b.Query(escape("'?' in parents and trashed = false", parent_id))
+}
+
+// Returns the files matching q, sorted by name. Only what MegaDrive asks for is understood: "'<id>' in parents" and "<field> = <value>" for name, mimeType and trashed, joined by "and".
+func (b *FakeDriveBackend) Query(q string) ([]*drive.File, error) {
+	clauses, err := fake_drive_parse(q)
+	if err != nil {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ans := make([]*drive.File, 0)
+	for _, f := range b.files {
+		if f.matches(clauses, b.root_id) {
+			ans = append(ans, f.copy())
+		}
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		if ans[i].Name != ans[j].Name {
+			return ans[i].Name < ans[j].Name
+		}
+		return ans[i].Id < ans[j].Id
+	})
+	return ans, nil
+}
+
+func (b *FakeDriveBackend) Download(google_id string, start, end int64) (io.ReadCloser, bool, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	f, err := b.lookup(google_id)
+	if err != nil {
+		return nil, false, err
+	}
+	if strings.HasPrefix(f.file.MimeType, "application/vnd.google-apps.") {
+		return nil, false, &googleapi.Error{Code: http.StatusForbidden, Message: "Only files with binary content can be downloaded. Use Export with Docs Editors files."}
+	}
+	content := f.content
+	partial := false
+	if end >= 0 {
+		if start >= int64(len(content)) || start > end {
+			return nil, false, &googleapi.Error{Code: http.StatusRequestedRangeNotSatisfiable, Message: "Request range not satisfiable"}
+		}
+		if end >= int64(len(content)) {
+			end = int64(len(content)) - 1
+		}
+		content = content[start : end+1]
+		partial = true
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), partial, nil
+}
+
+// Google-native files keep their content already exported, so it is returned for any supported mime_type.
+func (b *FakeDriveBackend) Export(google_id, mime_type string) (io.ReadCloser, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	f, err := b.lookup(google_id)
+	if err != nil {
+		return nil, err
+	}
+	if _, export := DriveExportMimeType(f.file.MimeType); !export {
+		return nil, &googleapi.Error{Code: http.StatusForbidden, Message: "Export only supports Docs Editors files."}
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+func (b *FakeDriveBackend) Create(file *drive.File, media io.Reader) (*drive.File, error) {
+	var content []byte
+	if media != nil {
+		var err error
+		if content, err = ioutil.ReadAll(media); err != nil {
+			return nil, err
+		}
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	google_id := file.Id
+	if google_id == "" {
+		google_id = b.new_id()
+	} else if _, found := b.files[google_id]; found {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: "A file already exists with the provided ID."}
+	}
+	parents := make([]string, 0)
+	for _, parent := range file.Parents {
+		p, err := b.lookup(parent)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, p.file.Id)
+	}
+	if len(parents) == 0 {
+		parents = append(parents, b.root_id)
+	}
+	mime_type := file.MimeType
+	if mime_type == "" {
+		mime_type = "application/octet-stream"
+	}
+	now := b.Now().UTC().Format(time.RFC3339)
+	f := &fake_drive_file{file: drive.File{
+		Id:           google_id,
+		Name:         file.Name,
+		MimeType:     mime_type,
+		Parents:      parents,
+		CreatedTime:  now,
+		ModifiedTime: now,
+	}}
+	if mime_type != MimeTypeGoogleFolder {
+		f.set_content(content)
+	}
+	b.files[google_id] = f
+	b.changed(f)
+	return f.copy(), nil
+}
+
+func (b *FakeDriveBackend) Update(google_id string, file *drive.File, media io.Reader, add_parent, remove_parent string) (*drive.File, error) {
+	var content []byte
+	if media != nil {
+		var err error
+		if content, err = ioutil.ReadAll(media); err != nil {
+			return nil, err
+		}
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	f, err := b.lookup(google_id)
+	if err != nil {
+		return nil, err
+	}
+	if file.Name != "" {
+		f.file.Name = file.Name
+	}
+	if file.Trashed {
+		f.file.Trashed = true
+	}
+	if remove_parent != "" {
+		p, err := b.lookup(remove_parent)
+		if err != nil {
+			return nil, err
+		}
+		parents := make([]string, 0)
+		for _, parent := range f.file.Parents {
+			if parent != p.file.Id {
+				parents = append(parents, parent)
+			}
+		}
+		f.file.Parents = parents
+	}
+	if add_parent != "" {
+		p, err := b.lookup(add_parent)
+		if err != nil {
+			return nil, err
+		}
+		f.file.Parents = append(f.file.Parents, p.file.Id)
+	}
+	if media != nil {
+		f.set_content(content)
+	}
+	f.file.ModifiedTime = b.Now().UTC().Format(time.RFC3339)
+	b.changed(f)
+	return f.copy(), nil
+}
+
+// Like Google Drive, deleting a folder for good also deletes everything inside it.
+func (b *FakeDriveBackend) Delete(google_id string, permanently bool) error {
+	if !permanently {
+		_, err := b.Update(google_id, &drive.File{Trashed: true}, nil, "", "")
+		return err
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	f, err := b.lookup(google_id)
+	if err != nil {
+		return err
+	}
+	queue := []string{f.file.Id}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		delete(b.files, id)
+		b.changes = append(b.changes, &drive.Change{FileId: id, Removed: true})
+		for child_id, child := range b.files {
+			for _, parent := range child.file.Parents {
+				if parent == id {
+					queue = append(queue, child_id)
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *FakeDriveBackend) GenerateIds(count int) ([]string, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ids := make([]string, count)
+	for i := range ids {
+		ids[i] = b.new_id()
+	}
+	return ids, nil
+}
+
+// Page tokens are positions in the list of changes.
+func (b *FakeDriveBackend) StartPageToken() (string, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return strconv.Itoa(len(b.changes)), nil
+}
+
+func (b *FakeDriveBackend) Changes(page_token string) ([]*drive.Change, string, string, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	start, err := strconv.Atoi(page_token)
+	if err != nil || start < 0 || start > len(b.changes) {
+		return nil, "", "", &googleapi.Error{Code: http.StatusNotFound, Message: "Invalid page token"}
+	}
+	end := start + CHANGES_PAGE_SIZE
+	if end >= len(b.changes) {
+		return b.changes[start:], "", strconv.Itoa(len(b.changes)), nil
+	}
+	return b.changes[start:end], strconv.Itoa(end), "", nil
+}
+
+// Ids look like real ones, so they are not mistaken for something else on CacheDir.
+func (b *FakeDriveBackend) new_id() string {
+	b.next_id++
+	return fmt.Sprintf("fake%016d", b.next_id)
+}
+
+func (b *FakeDriveBackend) lookup(google_id string) (*fake_drive_file, error) {
+	if google_id == "root" {
+		google_id = b.root_id
+	}
+	f, found := b.files[google_id]
+	if !found {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "File not found: " + google_id + "."}
+	}
+	return f, nil
+}
+
+// Saves a copy of f, as it is now, as the newest change.
+func (b *FakeDriveBackend) changed(f *fake_drive_file) {
+	b.changes = append(b.changes, &drive.Change{FileId: f.file.Id, File: f.copy()})
+}
+
+func (f *fake_drive_file) set_content(content []byte) {
+	f.content = content
+	f.revision++
+	f.file.Size = int64(len(content))
+	f.file.HeadRevisionId = strconv.Itoa(f.revision)
+	// Google-native files have no MD5
+	f.file.Md5Checksum = ""
+	if !strings.HasPrefix(f.file.MimeType, "application/vnd.google-apps.") {
+		sum := md5.Sum(content)
+		f.file.Md5Checksum = hex.EncodeToString(sum[:])
+	}
+}
+
+// Callers are free to change what they get.
+func (f *fake_drive_file) copy() *drive.File {
+	file := f.file
+	file.Parents = append([]string{}, f.file.Parents...)
+	return &file
+}
+
+type fake_drive_clause struct {
+	field string
+	value string
+}
+
+func (f *fake_drive_file) matches(clauses []fake_drive_clause, root_id string) bool {
+	for _, c := range clauses {
+		switch c.field {
+		case "parents":
+			value := c.value
+			if value == "root" {
+				value = root_id
+			}
+			found := false
+			for _, parent := range f.file.Parents {
+				found = found || parent == value
+			}
+			if !found {
+				return false
+			}
+		case "name":
+			if f.file.Name != c.value {
+				return false
+			}
+		case "mimeType":
+			if f.file.MimeType != c.value {
+				return false
+			}
+		case "trashed":
+			if strconv.FormatBool(f.file.Trashed) != c.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Parses queries made by escape, like "'<id>' in parents and trashed = false".
+func fake_drive_parse(q string) ([]fake_drive_clause, error) {
+	tokens, err := fake_drive_tokens(q)
+	if err != nil {
+		return nil, err
+	}
+	clauses := make([]fake_drive_clause, 0)
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("invalid query: %s", q)
+		}
+		switch {
+		case tokens[0].quoted && tokens[1].text == "in" && tokens[2].text == "parents":
+			clauses = append(clauses, fake_drive_clause{"parents", tokens[0].text})
+		case !tokens[0].quoted && tokens[1].text == "=" && (tokens[0].text == "name" || tokens[0].text == "mimeType") && tokens[2].quoted:
+			clauses = append(clauses, fake_drive_clause{tokens[0].text, tokens[2].text})
+		case tokens[0].text == "trashed" && tokens[1].text == "=" && !tokens[2].quoted && (tokens[2].text == "true" || tokens[2].text == "false"):
+			clauses = append(clauses, fake_drive_clause{"trashed", tokens[2].text})
+		default:
+			return nil, fmt.Errorf("unsupported query: %s", q)
+		}
+		tokens = tokens[3:]
+		if len(tokens) > 0 {
+			if tokens[0].quoted || tokens[0].text != "and" || len(tokens) == 1 {
+				return nil, fmt.Errorf("unsupported query: %s", q)
+			}
+			tokens = tokens[1:]
+		}
+	}
+	return clauses, nil
+}
+
+type fake_drive_token struct {
+	text   string
+	quoted bool
+}
+
+func fake_drive_tokens(q string) ([]fake_drive_token, error) {
+	tokens := make([]fake_drive_token, 0)
+	for i := 0; i < len(q); {
+		switch {
+		case q[i] == ' ':
+			i++
+		case q[i] == '\'':
+			// escape puts a backslash before every quote
+			var buf bytes.Buffer
+			i++
+			for ; i < len(q) && q[i] != '\''; i++ {
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+				}
+				buf.WriteByte(q[i])
+			}
+			if i >= len(q) {
+				return nil, fmt.Errorf("unterminated string in query: %s", q)
+			}
+			i++
+			tokens = append(tokens, fake_drive_token{buf.String(), true})
+		default:
+			j := i
+			for j < len(q) && q[j] != ' ' && q[j] != '\'' {
+				j++
+			}
+			tokens = append(tokens, fake_drive_token{q[i:j], false})
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+var FAKE_DRIVE_TEST_TIME = time.Date(2020, 2, 20, 20, 20, 20, 0, time.UTC)
+
+// Points the cache at a temporary folder and returns an empty fake Drive.
+func fake_drive_env(t *testing.T) *FakeDriveBackend {
+	test_consumers_idle()
+	CacheDir = t.TempDir() + "/"
+	os.MkdirAll(PathInCache("tmp"), 0755)
+	MemCache = cache.New(15*time.Minute, 30*time.Minute)
+	Store = NewMemoryStore()
+	b := NewFakeDriveBackend()
+	b.Now = func() time.Time { return FAKE_DRIVE_TEST_TIME }
+	return b
+}
+
+func fake_drive_code(err error) int {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestFakeDriveParse(t *testing.T) {
+	cases := []struct {
+		q       string
+		clauses string
+	}{
+		{"", "[]"},
+		{escape("'?' in parents", "abc"), "[{parents abc}]"},
+		{escape("'?' in parents and trashed = false", "abc"), "[{parents abc} {trashed false}]"},
+		{escape("name = '?' and mimeType = '?'", "it's", MimeTypeGoogleFolder), "[{name it's} {mimeType " + MimeTypeGoogleFolder + "}]"},
+		{escape("name = '?'", "a and b"), "[{name a and b}]"},
+		{"trashed = true", "[{trashed true}]"},
+	}
+	for _, c := range cases {
+		clauses, err := fake_drive_parse(c.q)
+		if err != nil {
+			t.Errorf("fake_drive_parse(%q) failed: %v", c.q, err)
+			continue
+		}
+		if got := fmt.Sprint(clauses); got != c.clauses {
+			t.Errorf("fake_drive_parse(%q) returned %s instead of %s", c.q, got, c.clauses)
+		}
+	}
+	for _, q := range []string{
+		"name = 'unterminated",
+		"'abc' in parents or trashed = false",
+		"name contains 'abc'",
+		"trashed = maybe",
+		"name = abc",
+		"'abc' in parents and",
+	} {
+		if clauses, err := fake_drive_parse(q); err == nil {
+			t.Errorf("fake_drive_parse(%q) returned %v instead of failing", q, clauses)
+		}
+	}
+}
+
+func TestFakeDriveQuery(t *testing.T) {
+	b := fake_drive_env(t)
+	folder := b.Put("root", "folder", MimeTypeGoogleFolder, nil)
+	b.Put("root", "b.txt", "text/plain", []byte("b"))
+	a := b.Put("root", "a.txt", "text/plain", []byte("a"))
+	b.Put(folder.Id, "a.txt", "text/plain", []byte("inside"))
+	trashed := b.Put("root", "trashed.txt", "text/plain", nil)
+	if err := b.Delete(trashed.Id, false); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	names := func(q string) string {
+		files, err := b.Query(q)
+		if err != nil {
+			t.Fatalf("Query(%q) failed: %v", q, err)
+		}
+		ans := make([]string, 0)
+		for _, f := range files {
+			ans = append(ans, f.Name)
+		}
+		return fmt.Sprint(ans)
+	}
+	if got := names(escape("'?' in parents and trashed = false", "root")); got != "[a.txt b.txt folder]" {
+		t.Errorf("Listing root returned %s", got)
+	}
+	if got := names(escape("'?' in parents", b.RootId())); got != "[a.txt b.txt folder trashed.txt]" {
+		t.Errorf("Listing root with its real id returned %s", got)
+	}
+	if got := names(escape("name = '?' and trashed = false", "a.txt")); got != "[a.txt a.txt]" {
+		t.Errorf("Looking for a.txt returned %s", got)
+	}
+	if got := names(escape("mimeType = '?'", MimeTypeGoogleFolder)); got != "[My Drive folder]" {
+		t.Errorf("Looking for folders returned %s", got)
+	}
+	if _, err := b.Query("name contains 'a'"); fake_drive_code(err) != http.StatusBadRequest {
+		t.Errorf("An unsupported query gave %v instead of 400", err)
+	}
+
+	// Moving
+	if _, err := b.Update(a.Id, &drive.File{Name: "c.txt"}, nil, folder.Id, "root"); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if got := names(escape("'?' in parents", folder.Id)); got != "[a.txt c.txt]" {
+		t.Errorf("Listing folder after the move returned %s", got)
+	}
+	// Deleting a folder for good takes its files along
+	if err := b.Delete(folder.Id, true); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := b.Get(a.Id); fake_drive_code(err) != http.StatusNotFound {
+		t.Errorf("A file inside a deleted folder gave %v instead of 404", err)
+	}
+}
+
+func TestFakeDriveDownload(t *testing.T) {
+	b := fake_drive_env(t)
+	file := b.Put("root", "digits.txt", "text/plain", []byte("0123456789"))
+	doc := b.Put("root", "doc", MimeTypeGoogleDocument, []byte("exported"))
+
+	download := func(start, end int64) (string, bool, error) {
+		body, partial, err := b.Download(file.Id, start, end)
+		if err != nil {
+			return "", false, err
+		}
+		defer body.Close()
+		byt, _ := ioutil.ReadAll(body)
+		return string(byt), partial, nil
+	}
+	cases := []struct {
+		start, end int64
+		content    string
+		partial    bool
+	}{
+		{0, -1, "0123456789", false},
+		{0, 0, "0", true},
+		{3, 5, "345", true},
+		{8, 100, "89", true},
+	}
+	for _, c := range cases {
+		content, partial, err := download(c.start, c.end)
+		if err != nil || content != c.content || partial != c.partial {
+			t.Errorf("Download(%d, %d) returned %q, %v, %v instead of %q, %v", c.start, c.end, content, partial, err, c.content, c.partial)
+		}
+	}
+	if _, _, err := download(10, 20); fake_drive_code(err) != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Downloading past the end gave %v instead of 416", err)
+	}
+	if _, _, err := b.Download(doc.Id, 0, -1); fake_drive_code(err) != http.StatusForbidden {
+		t.Errorf("Downloading a Google Doc gave %v instead of 403", err)
+	}
+	if _, err := b.Export(file.Id, "text/plain"); fake_drive_code(err) != http.StatusForbidden {
+		t.Errorf("Exporting a text file gave %v instead of 403", err)
+	}
+	if _, _, err := b.Download("missing", 0, -1); fake_drive_code(err) != http.StatusNotFound {
+		t.Errorf("Downloading a missing file gave %v instead of 404", err)
+	}
+
+	// New content means a new revision and MD5
+	updated, err := b.Update(file.Id, &drive.File{}, bytes.NewReader([]byte("abc")), "", "")
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if updated.HeadRevisionId == file.HeadRevisionId || updated.Md5Checksum == file.Md5Checksum || updated.Size != 3 {
+		t.Errorf("Got %+v after changing the content of %+v", updated, file)
+	}
+	if doc.Md5Checksum != "" {
+		t.Errorf("A Google Doc has MD5 %s", doc.Md5Checksum)
+	}
+}
+
+func TestFakeDriveChanges(t *testing.T) {
+	b := fake_drive_env(t)
+	token, _ := b.StartPageToken()
+	changes, next_token, new_start_token, err := b.Changes(token)
+	if err != nil || len(changes) != 0 || next_token != "" || new_start_token != token {
+		t.Fatalf("Changes(%s) returned %d changes, %q, %q, %v when nothing changed", token, len(changes), next_token, new_start_token, err)
+	}
+
+	// One more than fits on a page
+	for i := 0; i < CHANGES_PAGE_SIZE; i++ {
+		b.Put("root", "file"+strconv.Itoa(i), "text/plain", nil)
+	}
+	last := b.Put("root", "last", "text/plain", nil)
+	b.Delete(last.Id, true)
+	changes, next_token, new_start_token, err = b.Changes(token)
+	if err != nil || len(changes) != CHANGES_PAGE_SIZE || next_token == "" || new_start_token != "" {
+		t.Fatalf("The first page has %d changes, %q, %q, %v", len(changes), next_token, new_start_token, err)
+	}
+	changes, next_token, new_start_token, err = b.Changes(next_token)
+	if err != nil || len(changes) != 2 || next_token != "" || new_start_token == "" {
+		t.Fatalf("The second page has %d changes, %q, %q, %v", len(changes), next_token, new_start_token, err)
+	}
+	if changes[0].FileId != last.Id || changes[0].File.Name != "last" || !changes[1].Removed {
+		t.Errorf("Got %+v and %+v instead of the creation and removal of %s", changes[0], changes[1], last.Id)
+	}
+	if latest, _ := b.StartPageToken(); latest != new_start_token {
+		t.Errorf("StartPageToken is %s instead of %s", latest, new_start_token)
+	}
+	if _, _, _, err := b.Changes("nonsense"); fake_drive_code(err) != http.StatusNotFound {
+		t.Errorf("An invalid page token gave %v instead of 404", err)
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"google.golang.org/api/drive/v3"
 )
 
+// Only used while ChangesConsumer is not keeping the cache up to date.
 const GETBASICS_REFRESH_DELTA = 3 * time.Minute
 const GETBASICS_CACHE_ENABLE = true
 const GETBASICS_PRELOAD_ENABLE = true
@@ -30,17 +32,21 @@ func DriveGetBasicsPreload(google_id string) {
 // Adds the desired file id to ChBasicInfoReq and waits for the answer
 func DriveGetBasics(google_id string) fuse.Status {
 	// Check for cached copy
-	refresh_time := CGetDef_int64("BasicAttr:"+google_id+":!RefrehTime", 0)
-	flag_ask_refresh := refresh_time < time.Now().Unix()
+	rec, found := BasicsGet(google_id)
+	refresh_time := rec.RefreshTime
+	flag_ask_refresh := refresh_time < time.Now().Unix() && (refresh_time == 0 || !ChangesTrusted())
 	flag_must_wait := refresh_time == 0 // Only wait for the answer when absolutely necessary
 
 	// Ensure we try again in case of error
-	ret := fuse.EIO
-	CGet("BasicAttr:"+google_id+":!ret", &ret)
-	if ret != fuse.OK {
+	ret := rec.Ret
+	if !found || ret != fuse.OK {
 		flag_ask_refresh = true
 		flag_must_wait = true
 	}
+	// Do not overwrite changes that were not uploaded yet
+	if ret == fuse.OK && JournalPending(google_id) {
+		flag_ask_refresh = false
+	}
 
 	if flag_ask_refresh || GETBASICS_CACHE_ENABLE == false {
 		if flag_must_wait || GETBASICS_CACHE_ENABLE == false {
@@ -61,19 +67,21 @@ func DriveGetBasics(google_id string) fuse.Status {
 			// Tell the DriveGetBasicsConsumer to load this file's info
 			// But do not wait for it
 			ChOpenDirReq <- google_id
-			Log.InfoF("%s (%s) will be refreshed later (async)", google_id, CGet_str("BasicAttr:"+google_id+":Name"))
+			Log.InfoF("%s (%s) will be refreshed later (async)", google_id, rec.Name)
 		}
 	}
 	// Get return value
 	ret = fuse.EIO
-	CGet("BasicAttr:"+google_id+":!ret", &ret)
+	if rec, found := BasicsGet(google_id); found {
+		ret = rec.Ret
+	}
 	if ret != fuse.OK {
 		Log.WarningF("Failed to get basics for %s: %v", google_id, ret)
 	}
 	return ret
 }
 
-func DriveGetBasicsConsumer() {
+func DriveGetBasicsConsumer(backend DriveBackend) {
 	Log.Notice("DriveGetBasicsConsumer: Started")
 	for {
 		google_id := ""
@@ -85,13 +93,13 @@ func DriveGetBasicsConsumer() {
 		}
 		_start := time.Now()
 		// Do not work twice TODO: use timeout
-		flag_working := CGetDef_bool("BasicAttr:"+google_id+":!working", false)
+		flag_working := CGetDef_bool("Basics:"+google_id+":!working", false)
 		if flag_working == true {
 			Log.DebugF("DriveGetBasicsConsumer: Skipping %s", google_id)
 			continue
 		}
 		// Actually work
-		DriveGetBasicsConsumerCore(google_id)
+		DriveGetBasicsConsumerCore(backend, google_id)
 		// Unlock answer mutexes
 		MapBasicInfoAnsMux.Lock()
 		for _, mux := range MapBasicInfoAns[google_id] {
@@ -104,7 +112,7 @@ func DriveGetBasicsConsumer() {
 	}
 }
 
-func DriveGetBasicsConsumerCore(google_id string) (ret_code fuse.Status) {
+func DriveGetBasicsConsumerCore(backend DriveBackend, google_id string) (ret_code fuse.Status) {
 	// Save ourselves
 	defer func() {
 		if r := recover(); r != nil {
@@ -115,56 +123,86 @@ func DriveGetBasicsConsumerCore(google_id string) (ret_code fuse.Status) {
 
 	_start := time.Now()
 	defer PrintCallDuration("DriveGetBasicsConsumerCore", &_start)
+	// Do not overwrite changes that were not uploaded yet
+	if JournalPending(google_id) && BasicsKnown(google_id) {
+		Log.DebugF("DriveGetBasicsConsumerCore: %s has pending changes, keeping the cached copy", google_id)
+		return fuse.OK
+	}
 	Log.InfoF("DriveGetBasicsConsumerCore: Loading %s from the Internet", google_id)
 
-	CSet("BasicAttr:"+google_id+":!working", true)
-	defer CSet("BasicAttr:"+google_id+":!working", false)
+	CSet("Basics:"+google_id+":!working", true)
+	defer CSet("Basics:"+google_id+":!working", false)
 
-	r, err := DriveClient.Files.Get(google_id).Fields("name, md5Checksum, modifiedTime, size, mimeType, createdTime").Do()
+	r, err := backend.Get(google_id)
 	if err != nil {
 		Log.ErrorF("Unable to GetAttr %s: %v", google_id, err)
-		CSet("BasicAttr:"+google_id+":!ret", fuse.EIO)
+		// Keep serving what we have while offline
+		if !DriveIsNotFound(err) && BasicsKnown(google_id) {
+			return fuse.EIO
+		}
+		BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.Ret = fuse.EIO })
 		return fuse.EIO
 	}
 	Log.InfoF("DriveGetBasicsConsumerCore: LOADED %s (%s) from the Internet", google_id, r.Name)
 
+	// Tell the kernel if the content changed
+	if old, found := BasicsGet(google_id); found && old.Name != "" && (old.MD5 != r.Md5Checksum || old.Revision != r.HeadRevisionId) {
+		NotifyFile(google_id)
+	}
+
 	// Set cache
-	ret := DriveGetBasicsPut(google_id, r.Name, r.MimeType, r.Md5Checksum, r.Size, r.ModifiedTime, r.CreatedTime)
+	r.Id = google_id
+	ret := DriveGetBasicsPutFile(r)
 	return ret
 }
 
-func DriveGetBasicsPut(google_id string, name string, mimeType string, md5 string, size int64, modifiedTime string, createdTime string) fuse.Status {
+// Same as DriveGetBasicsPut but takes what Google Drive returned (DriveFileFields must have been requested).
+func DriveGetBasicsPutFile(file *drive.File) fuse.Status {
+	return drive_get_basics_put(file.Id, file.Name, file.MimeType, file.Md5Checksum, file.HeadRevisionId, file.Size, file.ModifiedTime, file.CreatedTime, file.Parents)
+}
+
+func DriveGetBasicsPut(google_id string, name string, mimeType string, md5 string, revision string, size int64, modifiedTime string, createdTime string) fuse.Status {
+	return drive_get_basics_put(google_id, name, mimeType, md5, revision, size, modifiedTime, createdTime, nil)
+}
+
+// parents may be nil if they are not known, in which case the ones saved before are kept.
+func drive_get_basics_put(google_id string, name string, mimeType string, md5 string, revision string, size int64, modifiedTime string, createdTime string, parents []string) fuse.Status {
 	// Parse times
 	mtime, err := time.Parse(time.RFC3339, modifiedTime)
 	if err != nil {
 		Log.ErrorF("Unable to GetAttr %s: %v", google_id, err)
-		CSet("BasicAttr:"+google_id+":!ret", fuse.EIO)
+		BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.Ret = fuse.EIO })
 		return fuse.EIO
 	}
 	ctime, err := time.Parse(time.RFC3339, createdTime)
 	if err != nil {
 		Log.ErrorF("Unable to GetAttr %s: %v", google_id, err)
-		CSet("BasicAttr:"+google_id+":!ret", fuse.EIO)
+		BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.Ret = fuse.EIO })
 		return fuse.EIO
 	}
-	// Lock file metadata
-	CLock("BasicAttr:" + google_id + ":!mux")
-	defer CUnlock("BasicAttr:" + google_id + ":!mux")
 
 	// Save stuff
-	CSet("BasicAttr:"+google_id+":!RefrehTime", time.Now().Add(GETBASICS_REFRESH_DELTA).Unix())
-	CSet("BasicAttr:"+google_id+":Name", name)
-	CSet("BasicAttr:"+google_id+":MimeType", mimeType)
-	CSet("BasicAttr:"+google_id+":MD5", md5)
-	CSet("BasicAttr:"+google_id+":IsDir", mimeType == "application/vnd.google-apps.folder")
-	CSet("BasicAttr:"+google_id+":Size", uint64(size))
-	CSet("BasicAttr:"+google_id+":Atime", uint64(mtime.Unix()))
-	CSet("BasicAttr:"+google_id+":Ctime", uint64(ctime.Unix()))
-	CSet("BasicAttr:"+google_id+":Mtime", uint64(mtime.Unix()))
-	CSet("BasicAttr:"+google_id+":Atimensec", uint32(mtime.UnixNano()))
-	CSet("BasicAttr:"+google_id+":Ctimensec", uint32(ctime.UnixNano()))
-	CSet("BasicAttr:"+google_id+":Mtimensec", uint32(mtime.UnixNano()))
-	CSet("BasicAttr:"+google_id+":!ret", fuse.OK)
+	BasicsUpdate(google_id, func(rec *BasicsRecord) {
+		if parents == nil {
+			parents = rec.Parents
+		}
+		*rec = BasicsRecord{
+			Name:        name,
+			MimeType:    mimeType,
+			MD5:         md5,
+			Revision:    revision,
+			Parents:     parents,
+			Size:        uint64(size),
+			Atime:       uint64(mtime.Unix()),
+			Ctime:       uint64(ctime.Unix()),
+			Mtime:       uint64(mtime.Unix()),
+			Atimensec:   uint32(mtime.Nanosecond()),
+			Ctimensec:   uint32(ctime.Nanosecond()),
+			Mtimensec:   uint32(mtime.Nanosecond()),
+			RefreshTime: time.Now().Add(GETBASICS_REFRESH_DELTA).Unix(),
+			Ret:         fuse.OK,
+		}
+	})
 	Log.InfoF("Updated BasicAttr for %s (%s)", google_id, name)
 	return fuse.OK
 }
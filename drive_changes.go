@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const CHANGES_POLL_INTERVAL = 30 * time.Second
+const CHANGES_PAGE_SIZE = 1000
+
+// If Google Drive can not be reached for this long, BasicsRecord and OpenDir go back to expiring after GETBASICS_REFRESH_DELTA and OPENDIR_REFRESH_DELTA.
+const CHANGES_TRUST_DELTA = 3 * CHANGES_POLL_INTERVAL
+
+// ChangesConsumer follows Google Drive's Changes API from the page token saved at "Changes:!PageToken". Every change updates the BasicsRecord of the file and expires the listings of its old and new parents, so the rest of the cache can be trusted for as long as ChangesConsumer keeps up.
+var ChangesLastPoll int64
+
+// Tells whether the cache is being kept up to date by ChangesConsumer.
+func ChangesTrusted() bool {
+	last := atomic.LoadInt64(&ChangesLastPoll)
+	return last != 0 && time.Now().Unix()-last < int64(CHANGES_TRUST_DELTA/time.Second)
+}
+
+func ChangesConsumer(backend DriveBackend) {
+	Log.Notice("ChangesConsumer: Started")
+	for !Unmounting() {
+		if err := ChangesPoll(backend); err != nil {
+			Log.WarningF("ChangesConsumer: Failed to poll changes: %v", err)
+		} else {
+			atomic.StoreInt64(&ChangesLastPoll, time.Now().Unix())
+		}
+		time.Sleep(CHANGES_POLL_INTERVAL)
+	}
+}
+
+// Applies every change since the saved page token.
+func ChangesPoll(backend DriveBackend) (ret_err error) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_err = &RecoveredError{r}
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("ChangesPoll", &_start)
+
+	// Changes name the real root id, but we call it "root"
+	if !CFound("Changes:!RootId") {
+		r, err := backend.Get("root")
+		if err != nil {
+			return err
+		}
+		CSet("Changes:!RootId", r.Id)
+	}
+
+	token := CGet_str("Changes:!PageToken")
+	if token == "" {
+		start_token, err := backend.StartPageToken()
+		if err != nil {
+			return err
+		}
+		Log.InfoF("ChangesPoll: Starting at page token %s", start_token)
+		// Anything could have changed before we started following changes
+		ChangesExpireAll()
+		CSet("Changes:!PageToken", start_token)
+		return nil
+	}
+
+	for token != "" {
+		changes, next_token, new_start_token, err := backend.Changes(token)
+		if err != nil {
+			if e, ok := err.(*googleapi.Error); ok && (e.Code == http.StatusNotFound || e.Code == http.StatusGone) {
+				Log.WarningF("ChangesPoll: Page token %s is no longer valid, starting over", token)
+				CDel("Changes:!PageToken")
+			}
+			return err
+		}
+		for _, change := range changes {
+			ChangesApply(change)
+		}
+		// Only move on once every change on this page was applied
+		if new_start_token != "" {
+			CSet("Changes:!PageToken", new_start_token)
+			break
+		}
+		token = next_token
+		CSet("Changes:!PageToken", token)
+	}
+	return nil
+}
+
+// Updates the cache after change.FileId changed on Google Drive.
+func ChangesApply(change *drive.Change) {
+	google_id := change.FileId
+	old, _ := BasicsGet(google_id)
+	// Do not overwrite changes that were not uploaded yet, but remember where the file was and went
+	if JournalPending(google_id) {
+		Log.DebugF("ChangesApply: %s has pending changes, applying remote change once they are uploaded", google_id)
+		parents := old.Parents
+		if change.File != nil {
+			parents = append(parents, change.File.Parents...)
+		}
+		ChangesSkip(google_id, parents)
+		return
+	}
+
+	old_parents := old.Parents
+	old_name := old.Name
+
+	if change.Removed || change.File == nil || change.File.Trashed {
+		Log.InfoF("ChangesApply: %s (%s) was removed", google_id, old_name)
+		for _, parent := range old_parents {
+			for _, name := range DriveOpenDirRemoveId(changes_local_id(parent), google_id) {
+				NotifyDelete(changes_local_id(parent), name)
+			}
+		}
+		DriveForget(google_id)
+		return
+	}
+
+	file := change.File
+	Log.InfoF("ChangesApply: %s (%s) was changed", google_id, file.Name)
+	moved := old_name != file.Name || !same_strings(old_parents, file.Parents)
+	file.Id = google_id
+	DriveGetBasicsPutFile(file)
+	NotifyFile(google_id)
+	if moved {
+		for _, parent := range old_parents {
+			for _, name := range DriveOpenDirRemoveId(changes_local_id(parent), google_id) {
+				NotifyDelete(changes_local_id(parent), name)
+			}
+			DriveOpenDirExpire(changes_local_id(parent))
+		}
+		for _, parent := range file.Parents {
+			DriveOpenDirExpire(changes_local_id(parent))
+			NotifyEntry(changes_local_id(parent), DriveSanitizeName(file.Name, file.MimeType))
+		}
+	}
+}
+
+// Saves the parents of a change to google_id that ChangesApply could not apply. "Changes:<id>:!skipped" piles them up until ChangesApplySkipped is called.
+func ChangesSkip(google_id string, parents []string) {
+	var skipped []string
+	CGet("Changes:"+google_id+":!skipped", &skipped)
+	for _, parent := range parents {
+		if !changes_contains(skipped, parent) {
+			skipped = append(skipped, parent)
+		}
+	}
+	CSet("Changes:"+google_id+":!skipped", skipped)
+}
+
+// Makes google_id and the folders it was and went to be loaded again if ChangesApply skipped a change to it. JournalDone calls this once google_id has nothing left to upload.
+func ChangesApplySkipped(google_id string) {
+	if !CFound("Changes:" + google_id + ":!skipped") {
+		return
+	}
+	var parents []string
+	CGet("Changes:"+google_id+":!skipped", &parents)
+	rec, found := BasicsGet(google_id)
+	parents = append(parents, rec.Parents...)
+	Log.InfoF("ChangesApplySkipped: Loading %s (%s) and %d folders again", google_id, rec.Name, len(parents))
+	for _, parent := range parents {
+		parent = changes_local_id(parent)
+		// Listings with their own pending changes are loaded again once those are uploaded
+		if !JournalPending(parent) {
+			for _, name := range DriveOpenDirRemoveId(parent, google_id) {
+				NotifyDelete(parent, name)
+			}
+		}
+		DriveOpenDirExpire(parent)
+	}
+	if found {
+		BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.RefreshTime = 0 })
+	}
+	NotifyFile(google_id)
+	CDel("Changes:" + google_id + ":!skipped")
+}
+
+// Makes every BasicsRecord and OpenDir be loaded again before it is used.
+func ChangesExpireAll() {
+	keys := make([]string, 0)
+	for _, key := range CKeysPrefix("OpenDir:") {
+		if strings.HasSuffix(key, ":!RefrehTime") {
+			keys = append(keys, key)
+		}
+	}
+	CDel(keys...)
+	Log.InfoF("ChangesExpireAll: Expired %d files and %d folders", BasicsExpireAll(), len(keys))
+}
+
+func changes_local_id(google_id string) string {
+	if google_id == CGet_str("Changes:!RootId") {
+		return "root"
+	}
+	return google_id
+}
+
+func changes_contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func same_strings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		if !seen[s] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Applies every change made to b since token and returns the next token.
+func changes_apply_all(t *testing.T, b *FakeDriveBackend, token string) string {
+	for {
+		changes, next_token, new_start_token, err := b.Changes(token)
+		if err != nil {
+			t.Fatalf("Changes(%s) failed: %v", token, err)
+		}
+		for _, change := range changes {
+			ChangesApply(change)
+		}
+		if new_start_token != "" {
+			return new_start_token
+		}
+		token = next_token
+	}
+}
+
+func TestChangesApply(t *testing.T) {
+	b := fake_drive_env(t)
+	CSet("Changes:!RootId", b.RootId())
+	a := b.Put("root", "a", MimeTypeGoogleFolder, nil)
+	c := b.Put("root", "c", MimeTypeGoogleFolder, nil)
+	file := b.Put(a.Id, "file.txt", "text/plain", []byte("content"))
+	for _, id := range []string{"root", a.Id, c.Id} {
+		DriveOpenDirConsumerCore(b, id)
+	}
+	token, _ := b.StartPageToken()
+
+	// Moved on Google Drive
+	if _, err := b.Update(file.Id, &drive.File{Name: "moved.txt"}, nil, c.Id, a.Id); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	changes_apply_all(t, b, token)
+	if CFound("Lookup:file.txt:in:" + a.Id + ":id") {
+		t.Errorf("file.txt is still in a")
+	}
+	if CFound("OpenDir:" + c.Id + ":!RefrehTime") {
+		t.Errorf("The listing of c was not expired")
+	}
+	if rec, _ := BasicsGet(file.Id); rec.Name != "moved.txt" {
+		t.Errorf("The file is called %s instead of moved.txt", rec.Name)
+	}
+}
+
+func TestChangesApplyPending(t *testing.T) {
+	b := fake_drive_env(t)
+	CSet("Changes:!RootId", b.RootId())
+	a := b.Put("root", "a", MimeTypeGoogleFolder, nil)
+	c := b.Put("root", "c", MimeTypeGoogleFolder, nil)
+	file := b.Put(a.Id, "file.txt", "text/plain", []byte("content"))
+	for _, id := range []string{"root", a.Id, c.Id} {
+		DriveOpenDirConsumerCore(b, id)
+	}
+	token, _ := b.StartPageToken()
+
+	// Moved on Google Drive while a local write waits to be uploaded
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: file.Id})
+	if _, err := b.Update(file.Id, &drive.File{Name: "moved.txt"}, nil, c.Id, a.Id); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	changes_apply_all(t, b, token)
+	if rec, _ := BasicsGet(file.Id); rec.Name != "file.txt" {
+		t.Errorf("The pending file was renamed to %s", rec.Name)
+	}
+	if !CFound("Lookup:file.txt:in:" + a.Id + ":id") {
+		t.Errorf("The pending file is no longer in a")
+	}
+
+	// Once uploaded, the move shows up
+	key, entry, _ := journal_start()
+	JournalDone(key, entry)
+	if CFound("Lookup:file.txt:in:" + a.Id + ":id") {
+		t.Errorf("file.txt is still in a after the upload")
+	}
+	for _, id := range []string{a.Id, c.Id} {
+		if CFound("OpenDir:" + id + ":!RefrehTime") {
+			t.Errorf("The listing of %s was not expired", id)
+		}
+	}
+	if rec, _ := BasicsGet(file.Id); rec.RefreshTime != 0 {
+		t.Errorf("The basics of the file were not expired")
+	}
+	DriveOpenDirConsumerCore(b, c.Id)
+	if CGet_str("Lookup:moved.txt:in:"+c.Id+":id") != file.Id {
+		t.Errorf("moved.txt is not in c")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Tells whether google_id was changed on Google Drive since we downloaded (or last uploaded) it. The remote metadata is returned so DriveSaveConflict does not need to ask for it again.
+func DriveCheckConflict(backend DriveBackend, google_id string) (remote *drive.File, conflict bool, err error) {
+	base_md5 := CGet_str("Read:" + google_id + ":!MD5")
+	base_rev := CGet_str("Read:" + google_id + ":!Revision")
+	if base_md5 == "" && base_rev == "" {
+		// We have no idea what the local copy was based on
+		return nil, false, nil
+	}
+
+	remote, err = backend.Get(google_id)
+	if err != nil {
+		return nil, false, err
+	}
+	if base_rev != "" && remote.HeadRevisionId != "" {
+		conflict = remote.HeadRevisionId != base_rev
+	} else {
+		conflict = remote.Md5Checksum != base_md5
+	}
+	return remote, conflict, nil
+}
+
+// Returns something like "name (conflict 2026-10-18 host).ext".
+func DriveConflictName(name string) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (conflict %s %s)%s", strings.TrimSuffix(name, ext), time.Now().Format("2006-01-02"), host, ext)
+}
+
+// Uploads the local copy of google_id next to it instead of overwriting the changes someone else made. remote must come from DriveCheckConflict.
+func DriveSaveConflict(backend DriveBackend, google_id string, remote *drive.File) error {
+	name := DriveConflictName(remote.Name)
+	Log.WarningF("Conflict: %s (%s) was changed on Google Drive, saving our version as %s", google_id, remote.Name, name)
+
+	// Upload our version as a new file
+	r, err := os.Open(CacheDir + google_id)
+	if err != nil {
+		return err
+	}
+	file := &drive.File{
+		Name:     name,
+		MimeType: remote.MimeType,
+		Parents:  remote.Parents,
+	}
+	ans, err := backend.Create(file, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	Log.InfoF("DriveSaveConflict: SAVED %s (%s) on the Internet", ans.Id, name)
+
+	// Our version now lives under the new id and theirs will be downloaded again
+	if err := os.Rename(CacheDir+google_id, CacheDir+ans.Id); err != nil {
+		Log.WarningF("Failed to move cache file for %s to %s: %v", google_id, ans.Id, err)
+	} else {
+		DriveWriteMarkCached(ans)
+	}
+	DriveGetBasicsPutFile(ans)
+	DriveGetBasicsPutFile(remote)
+	CDel("Read:" + google_id + ":!ret")
+	for _, parent := range remote.Parents {
+		DriveOpenDirAdd(parent, DriveSanitizeName(ans.Name, ans.MimeType), ans.Id, false)
+	}
+	CSet("Conflict:"+google_id, name)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"google.golang.org/api/drive/v3"
+)
+
+// Pretends file was downloaded and then changed locally to content.
+func conflict_edit(t *testing.T, file *drive.File, content string) {
+	if err := ioutil.WriteFile(CacheDir+file.Id, []byte(content), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	DriveGetBasicsPutFile(file)
+	CApply(map[string]interface{}{
+		"Read:" + file.Id + ":!ret":      fuse.OK,
+		"Read:" + file.Id + ":!MD5":      file.Md5Checksum,
+		"Read:" + file.Id + ":!Revision": file.HeadRevisionId,
+	})
+}
+
+// Returns the content of google_id on b.
+func conflict_content(t *testing.T, b DriveBackend, google_id string) string {
+	body, _, err := b.Download(google_id, 0, -1)
+	if err != nil {
+		t.Fatalf("Download(%s) failed: %v", google_id, err)
+	}
+	defer body.Close()
+	byt, _ := ioutil.ReadAll(body)
+	return string(byt)
+}
+
+func TestDriveUpdateNoConflict(t *testing.T) {
+	b := fake_drive_env(t)
+	file := b.Put("root", "notes.txt", "text/plain", []byte("base"))
+	conflict_edit(t, file, "mine")
+	if _, conflict, err := DriveCheckConflict(b, file.Id); conflict || err != nil {
+		t.Fatalf("DriveCheckConflict returned %v, %v for a file nobody else changed", conflict, err)
+	}
+	if err := DriveUpdate(b, file.Id); err != nil {
+		t.Fatalf("DriveUpdate failed: %v", err)
+	}
+	if got := conflict_content(t, b, file.Id); got != "mine" {
+		t.Errorf("Got %q on the fake Drive instead of our version", got)
+	}
+	// The new version is the base of the next upload
+	if _, conflict, _ := DriveCheckConflict(b, file.Id); conflict {
+		t.Errorf("Our own upload is seen as a conflict")
+	}
+
+	// Files we know nothing about can not conflict
+	other := b.Put("root", "other.txt", "text/plain", nil)
+	if remote, conflict, err := DriveCheckConflict(b, other.Id); remote != nil || conflict || err != nil {
+		t.Errorf("DriveCheckConflict returned %v, %v, %v for a file that was never downloaded", remote, conflict, err)
+	}
+}
+
+func TestDriveUpdateConflict(t *testing.T) {
+	b := fake_drive_env(t)
+	file := b.Put("root", "notes.txt", "text/plain", []byte("base"))
+	conflict_edit(t, file, "mine")
+	if _, err := b.Update(file.Id, &drive.File{}, bytes.NewReader([]byte("theirs")), "", ""); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, conflict, err := DriveCheckConflict(b, file.Id); !conflict || err != nil {
+		t.Fatalf("DriveCheckConflict returned %v, %v for a file someone else changed", conflict, err)
+	}
+	if err := DriveUpdate(b, file.Id); err != nil {
+		t.Fatalf("DriveUpdate failed: %v", err)
+	}
+
+	// Theirs stays, ours is saved next to it
+	if got := conflict_content(t, b, file.Id); got != "theirs" {
+		t.Errorf("Got %q instead of their version", got)
+	}
+	name := CGet_str("Conflict:" + file.Id)
+	if name != DriveConflictName("notes.txt") {
+		t.Fatalf("Conflict:%s is %q instead of %q", file.Id, name, DriveConflictName("notes.txt"))
+	}
+	files, _ := b.List("root")
+	var saved *drive.File
+	for _, f := range files {
+		if f.Name == name {
+			saved = f
+		}
+	}
+	if saved == nil {
+		t.Fatalf("%s is not on the fake Drive", name)
+	}
+	if got := conflict_content(t, b, saved.Id); got != "mine" {
+		t.Errorf("The conflict copy has %q instead of our version", got)
+	}
+	// Our local copy moved to the new file and theirs will be downloaded again
+	if got, err := ioutil.ReadFile(CacheDir + saved.Id); err != nil || string(got) != "mine" {
+		t.Errorf("The cached copy of %s has %q (%v)", saved.Id, got, err)
+	}
+	if _, err := os.Stat(CacheDir + file.Id); !os.IsNotExist(err) || CFound("Read:"+file.Id+":!ret") {
+		t.Errorf("The old copy of %s is still cached (%v)", file.Id, err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 )
 
 const MimeTypeGoogleAudio = "application/vnd.google-apps.audio"
@@ -31,6 +32,9 @@ const MimeTypeGoogleUnknown = "application/vnd.google-apps.unknown"
 const MimeTypeGoogleVideo = "application/vnd.google-apps.video"
 const MimeTypeGoogleDriveSdk = "application/vnd.google-apps.drive-sdk"
 
+// What we ask Google Drive about every file. DriveGetBasicsPutFile expects all of these.
+const DriveFileFields = "id, name, md5Checksum, headRevisionId, modifiedTime, size, mimeType, createdTime, parents"
+
 const DevSecret = "{\"installed\":{\"client_id\":\"247137966113-i7t9f4qmg579dc5kjkoe9o1fiavemu1h.apps.googleusercontent.com\",\"project_id\":\"elevated-codex-175014\",\"auth_uri\":\"https://accounts.google.com/o/oauth2/auth\",\"token_uri\":\"https://accounts.google.com/o/oauth2/token\",\"auth_provider_x509_cert_url\":\"https://www.googleapis.com/oauth2/v1/certs\",\"client_secret\":\"zsJmWViFbtFh7tyCgTNHxINw\",\"redirect_uris\":[\"urn:ietf:wg:oauth:2.0:oob\",\"http://localhost\"]}}"
 
 // getClient uses a Context and Config to retrieve a Token
@@ -100,11 +104,19 @@ func saveToken(file string, token *oauth2.Token) {
 
 var DriveCtx context.Context
 var DriveConfig *oauth2.Config
-var DriveClient *drive.Service
 
-func GetDriveClient() *drive.Service {
+// endpoint replaces Google Drive's own (like the URL printed by "MegaDrive stand-in DIR"). No authentication is done for it.
+func GetDriveClient(endpoint string) *drive.Service {
 	var err error
 	DriveCtx = context.Background()
+	if endpoint != "" {
+		srv, err := drive.New(http.DefaultClient)
+		if err != nil {
+			log.Fatalf("Unable to retrieve drive Client %v", err)
+		}
+		srv.BasePath = strings.TrimSuffix(endpoint, "/") + "/"
+		return srv
+	}
 	DriveConfig, err = google.ConfigFromJSON([]byte(DevSecret), drive.DriveScope)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
@@ -118,9 +130,20 @@ func GetDriveClient() *drive.Service {
 	return srv
 }
 
+// Tells whether err means the file does not exist (anymore) on Google Drive.
+func DriveIsNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
 func DriveSanitizeName(original_name, mime_type string) string {
 	name := strings.Replace(original_name, "/", "\u2215", -1)
 
+	// Exported files get the extension of the format they are exported as
+	if ext, ok := DriveExportExt(mime_type); ok {
+		return name + "." + ext
+	}
+
 	switch mime_type {
 	case MimeTypeGoogleAudio:
 		return name + ".gdaud"
@@ -159,6 +182,22 @@ func DriveSanitizeName(original_name, mime_type string) string {
 	}
 }
 
+// Undoes the character replacement done by DriveSanitizeName. File extensions are kept as they are.
+func DriveDesanitizeName(name string) string {
+	return strings.Replace(name, "\u2215", "/", -1)
+}
+
+// Recovers the Google Drive name from a name returned by DriveSanitizeName for the given mime type. Exported files may end with the extension of any format they can be exported as, not just the current one.
+func DriveNameFromSanitized(name, mime_type string) string {
+	name = DriveDesanitizeName(name)
+	for ext := range DriveExportMimeTypes[mime_type] {
+		if strings.HasSuffix(strings.ToLower(name), "."+ext) {
+			return name[:len(name)-len(ext)-1]
+		}
+	}
+	return strings.TrimSuffix(name, DriveSanitizeName("", mime_type))
+}
+
 func DriveUnambiguousName(id, original_name, mime_type string) string {
 	return DriveSanitizeName(original_name+" ("+id+")", mime_type)
 }
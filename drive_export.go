@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Formats each kind of Google-native file can be exported to, by extension.
+var DriveExportMimeTypes = map[string]map[string]string{
+	MimeTypeGoogleDocument: {
+		"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"odt":  "application/vnd.oasis.opendocument.text",
+		"pdf":  "application/pdf",
+	},
+	MimeTypeGoogleSpreadsheet: {
+		"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"ods":  "application/vnd.oasis.opendocument.spreadsheet",
+		"csv":  "text/csv",
+	},
+	MimeTypeGooglePresentation: {
+		"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"pdf":  "application/pdf",
+	},
+	MimeTypeGoogleDrawing: {
+		"svg": "image/svg+xml",
+		"png": "image/png",
+	},
+}
+
+// The extension each kind of Google-native file is currently exported as. Change it with DriveSetExportFormat.
+var DriveExportFormats = map[string]string{
+	MimeTypeGoogleDocument:     "docx",
+	MimeTypeGoogleSpreadsheet:  "xlsx",
+	MimeTypeGooglePresentation: "pptx",
+	MimeTypeGoogleDrawing:      "svg",
+}
+
+// Chooses ext as the format files of type mime_type will be exported as.
+func DriveSetExportFormat(mime_type, ext string) error {
+	ext = strings.TrimPrefix(strings.ToLower(ext), ".")
+	formats, ok := DriveExportMimeTypes[mime_type]
+	if !ok {
+		return fmt.Errorf("%s can not be exported", mime_type)
+	}
+	if _, ok := formats[ext]; !ok {
+		valid := make([]string, 0, len(formats))
+		for k := range formats {
+			valid = append(valid, k)
+		}
+		sort.Strings(valid)
+		return fmt.Errorf("%s can not be exported as %s (valid formats: %s)", mime_type, ext, strings.Join(valid, ", "))
+	}
+	DriveExportFormats[mime_type] = ext
+	return nil
+}
+
+// Returns the extension files of type mime_type are exported as. The boolean is false for files that are downloaded as they are.
+func DriveExportExt(mime_type string) (string, bool) {
+	ext, ok := DriveExportFormats[mime_type]
+	return ext, ok
+}
+
+// Returns the mime type to pass to Files.Export for files of type mime_type. The boolean is false for files that are downloaded as they are.
+func DriveExportMimeType(mime_type string) (string, bool) {
+	ext, ok := DriveExportFormats[mime_type]
+	if !ok {
+		return "", false
+	}
+	return DriveExportMimeTypes[mime_type][ext], true
+}
+
+// Drops the names and listings cached while other formats were chosen, as they have the extensions of those formats. Folders with uploads waiting keep theirs, since their listings can not be loaded again until then. Call it once the formats are chosen and Store is open.
+func DriveExportCheckFormats() {
+	byt, _ := json.Marshal(DriveExportFormats)
+	formats := string(byt)
+	old := CGet_str("Export:!Formats")
+	if old == formats {
+		return
+	}
+	if old != "" {
+		Log.NoticeF("Export formats changed from %s to %s, forgetting names of exported files", old, formats)
+	}
+	BasicsExpireAll()
+	del := make([]string, 0)
+	for _, key := range CKeysPrefix("OpenDir:") {
+		if !JournalPending(strings.SplitN(strings.TrimPrefix(key, "OpenDir:"), ":", 2)[0]) {
+			del = append(del, key)
+		}
+	}
+	// Lookup:<name>:in:<parent>:<field>
+	for _, key := range CKeysPrefix("Lookup:") {
+		i := strings.LastIndex(key, ":in:")
+		if i < 0 || !JournalPending(strings.SplitN(key[i+len(":in:"):], ":", 2)[0]) {
+			del = append(del, key)
+		}
+	}
+	CDel(del...)
+	CSet("Export:!Formats", formats)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDriveNameFromSanitized(t *testing.T) {
+	cases := []struct {
+		name, mime_type, expected string
+	}{
+		{"report.docx", MimeTypeGoogleDocument, "report"},
+		// Renaming to another format must not end up as report.odt.docx
+		{"report.odt", MimeTypeGoogleDocument, "report"},
+		{"report.ODT", MimeTypeGoogleDocument, "report"},
+		{"report.txt", MimeTypeGoogleDocument, "report.txt"},
+		{"sheet.csv", MimeTypeGoogleSpreadsheet, "sheet"},
+		{"a∕b.odt", "text/plain", "a/b.odt"},
+		{"folder", MimeTypeGoogleFolder, "folder"},
+	}
+	for _, c := range cases {
+		if got := DriveNameFromSanitized(c.name, c.mime_type); got != c.expected {
+			t.Errorf("DriveNameFromSanitized(%q, %s) returned %q instead of %q", c.name, c.mime_type, got, c.expected)
+		}
+	}
+}
+
+func TestDriveExportCheckFormats(t *testing.T) {
+	fake_drive_env(t)
+	seed := func() {
+		DriveGetBasicsPut("doc", "report", MimeTypeGoogleDocument, "", "", 0, "2020-02-20T20:20:20Z", "2020-02-20T20:20:20Z")
+		CSet("OpenDir:root", "[]")
+		CSet("Lookup:report.docx:in:root:id", "doc")
+		CSet("OpenDir:pending", "[]")
+		CSet("Lookup:new.docx:in:pending:id", "new")
+	}
+	expired := func() bool {
+		rec, _ := BasicsGet("doc")
+		return rec.RefreshTime == 0
+	}
+	DriveExportCheckFormats()
+	seed()
+	JournalAppend(JournalEntry{Op: JournalOpMkdir, GoogleId: "pending", NewParent: "elsewhere"})
+	// Same formats as last time
+	DriveExportCheckFormats()
+	if expired() || !CFound("OpenDir:root") || !CFound("Lookup:report.docx:in:root:id") {
+		t.Fatalf("Names were forgotten although the formats did not change")
+	}
+
+	old := DriveExportFormats[MimeTypeGoogleDocument]
+	defer DriveSetExportFormat(MimeTypeGoogleDocument, old)
+	if err := DriveSetExportFormat(MimeTypeGoogleDocument, "odt"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	DriveExportCheckFormats()
+	if !expired() || CFound("OpenDir:root") || CFound("Lookup:report.docx:in:root:id") {
+		t.Errorf("Names of the old format are still there")
+	}
+	if !CFound("OpenDir:pending") || !CFound("Lookup:new.docx:in:pending:id") {
+		t.Errorf("A folder with uploads waiting lost its listing")
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
 
+// Only used while ChangesConsumer is not keeping the cache up to date.
 const OPENDIR_REFRESH_DELTA = 3 * time.Minute
 const OPENDIR_WORK_TIMEOUT = 2 * time.Minute
 const OPENDIR_CACHE_ENABLE = true
 const OPENDIR_PRELOAD_ENABLE = true
 const OPENDIR_AUTO_CACHE_FOR_GETBASICS = true
 
+// How many files to ask for in each Files.List call. 1000 is the largest value Google Drive accepts.
+const OPENDIR_PAGE_SIZE = 1000
+
 // When we need a new directories list, we add its id to ChOpenDirReq which consumed ONLY by DriveOpenDirConsumer. We also add our own (locked) mutex to MapOpenDirAns. This way, whenever some function loads/reloads the piece of information we need, all functions waiting for it will have theirs mutexes unlocked, telling them that the information they need is now on the cache. DriveOpenDirConsumer is smart enough to efficiently handle the same file id being multiple times on ChOpenDirReq. LP means low priority and is used for preloading.
 var ChOpenDirReq = make(chan string, 64)
 var ChOpenDirReqLP = make(chan string, 64)
@@ -35,9 +38,14 @@ func DriveOpenDirPreload(google_id string) {
 func DriveOpenDir(google_id string) ([]fuse.DirEntry, fuse.Status) {
 	// Check for cached copy
 	refresh_time := CGetDef_int64("OpenDir:"+google_id+":!RefrehTime", 0)
-	flag_ask_refresh := refresh_time < time.Now().Unix()
+	flag_ask_refresh := refresh_time < time.Now().Unix() && (refresh_time == 0 || !ChangesTrusted())
 	flag_must_wait := refresh_time == 0 // Only wait for the answer when absolutely necessary
 
+	// Do not overwrite changes that were not uploaded yet
+	if JournalPending(google_id) && CFound("OpenDir:"+google_id) {
+		flag_ask_refresh = false
+	}
+
 	if flag_ask_refresh && OPENDIR_CACHE_ENABLE {
 		if flag_must_wait || OPENDIR_CACHE_ENABLE == false {
 			// Lock the MapBasicInfoAns for editing and add our own answer mutex
@@ -60,14 +68,15 @@ func DriveOpenDir(google_id string) ([]fuse.DirEntry, fuse.Status) {
 			Log.InfoF("%s will be refreshed later (async)", google_id)
 		}
 	}
-	var ans []fuse.DirEntry
-	var status fuse.Status
+	// Folders that were never loaded have no !ret and must not look like empty ones
+	ans := make([]fuse.DirEntry, 0)
+	status := fuse.EIO
 	CGet("OpenDir:"+google_id, &ans)
 	CGet("OpenDir:"+google_id+":!ret", &status)
 	return ans, status
 }
 
-func DriveOpenDirConsumer() {
+func DriveOpenDirConsumer(backend DriveBackend) {
 	Log.Notice("DriveOpenDirConsumer: Started")
 	for {
 		google_id := ""
@@ -79,7 +88,7 @@ func DriveOpenDirConsumer() {
 		}
 		_start := time.Now()
 		// Actually work
-		_, _, skip := DriveOpenDirConsumerCore(google_id)
+		_, _, skip := DriveOpenDirConsumerCore(backend, google_id)
 		if skip {
 			continue
 		}
@@ -95,7 +104,7 @@ func DriveOpenDirConsumer() {
 	}
 }
 
-func DriveOpenDirConsumerCore(google_id string) (ret_dirs []fuse.DirEntry, ret_code fuse.Status, skip bool) {
+func DriveOpenDirConsumerCore(backend DriveBackend, google_id string) (ret_dirs []fuse.DirEntry, ret_code fuse.Status, skip bool) {
 	ret_dirs = make([]fuse.DirEntry, 0)
 	ret_code = fuse.EIO
 
@@ -117,84 +126,231 @@ func DriveOpenDirConsumerCore(google_id string) (ret_dirs []fuse.DirEntry, ret_c
 		skip = true
 		return
 	}
+	// Do not overwrite changes that were not uploaded yet
+	if JournalPending(google_id) && CFound("OpenDir:"+google_id) {
+		Log.DebugF("DriveOpenDirConsumer: %s has pending changes, keeping the cached listing", google_id)
+		ret_code = fuse.OK
+		return
+	}
 	CSet("OpenDir:"+google_id+":!WorkTimeout", time.Now().Add(OPENDIR_WORK_TIMEOUT).Unix())
-	CSet("OpenDir:"+google_id+":!ret", fuse.EIO)
+	// Only skip while we are at it, otherwise a waiting DriveOpenDir (say, after ChangesExpireAll) is never answered
+	defer CDel("OpenDir:" + google_id + ":!WorkTimeout")
 	Log.InfoF("DriveOpenDirConsumerCore: Loading %s from the Internet", google_id)
 
-	// Call Google Drive
-	r, err := DriveClient.Files.List().
-		Fields("nextPageToken, files(id, name, modifiedTime, size, md5Checksum, mimeType, createdTime)").
-		Q(escape("'?' in parents and trashed = false", google_id)).
-		Do()
+	// Call Google Drive (only cache the listing once every page was loaded)
+	files, err := backend.List(google_id)
 	if err != nil {
 		Log.ErrorF("Unable to OpenDir %s: %v", google_id, err)
+		// Keep serving what we have while offline
+		if !DriveIsNotFound(err) && CFound("OpenDir:"+google_id) {
+			return
+		}
+		CSet("OpenDir:"+google_id+":!ret", fuse.EIO)
 		return
 	}
-	name := CGet_str("BasicAttr:" + google_id + ":Name")
-	Log.InfoF("DriveOpenDirConsumerCore: LOADED %s (%s) from the Internet", google_id, name)
-	Log.InfoF("DriveOpenDirConsumerCore: %+v", r.Files)
+	rec, _ := BasicsGet(google_id)
+	name := rec.Name
+	Log.InfoF("DriveOpenDirConsumerCore: LOADED %s (%s) from the Internet (%d files)", google_id, name, len(files))
 
+	// An empty folder is a normal (and cacheable) answer, so there is no special case for it
 	ret_dirs = make([]fuse.DirEntry, 0)
-	if len(r.Files) > 0 {
-		// Check for multiple files with the same name
-		used_names := make(map[string]bool)
-		doubled_names := make(map[string]bool)
-		for _, file := range r.Files {
-			n := MDNode{}
-			n.GoogleId = file.Id
-			n.Name = file.Name
-			n.MimeType = file.MimeType
-
-			name := n.SanitizedName()
-
-			if used_names[name] == true {
-				doubled_names[name] = true
-			}
-			used_names[name] = true
+
+	// Check for multiple files with the same name
+	used_names := make(map[string]bool)
+	doubled_names := make(map[string]bool)
+	for _, file := range files {
+		n := MDNode{}
+		n.GoogleId = file.Id
+		n.Name = file.Name
+		n.MimeType = file.MimeType
+
+		name := n.SanitizedName()
+
+		if used_names[name] == true {
+			doubled_names[name] = true
 		}
+		used_names[name] = true
+	}
 
-		// Return files found
-		for _, file := range r.Files {
-			n := MDNode{}
-			n.GoogleId = file.Id
-			n.Name = file.Name
-			n.MimeType = file.MimeType
+	// Return files found
+	for _, file := range files {
+		n := MDNode{}
+		n.GoogleId = file.Id
+		n.Name = file.Name
+		n.MimeType = file.MimeType
 
-			val := fuse.DirEntry{}
-			val.Name = n.SanitizedName()
-			// Be careful with files with equal names
-			if doubled_names[val.Name] == true {
-				val.Name = n.UnambiguousName()
-			}
-			if n.IsDir() {
-				val.Mode = fuse.S_IFDIR
-			}
-			ret_dirs = append(ret_dirs, val)
-
-			// Cache some stuff
-			CSet("Lookup:"+val.Name+":in:"+google_id+":id", n.GoogleId)
-			CSet("Lookup:"+val.Name+":in:"+google_id+":isDir", n.IsDir())
-			// "Preload" some stuff to make things quicker
-			if OPENDIR_AUTO_CACHE_FOR_GETBASICS {
-				found := CFoundPrefix("BasicAttr:"+google_id+":", "Name", "MimeType", "Size", "MD5", "Atime", "Ctime", "Mtime", "Atimensec", "Ctimensec", "Mtimensec")
-				if !found {
-					DriveGetBasicsPut(file.Id, file.Name, file.MimeType, file.Md5Checksum, file.Size, file.ModifiedTime, file.CreatedTime)
-					Log.DebugF("Preloaded %s (%s)", file.Id, file.Name)
-				}
+		val := fuse.DirEntry{}
+		val.Name = n.SanitizedName()
+		// Be careful with files with equal names
+		if doubled_names[val.Name] == true {
+			val.Name = n.UnambiguousName()
+		}
+		if n.IsDir() {
+			val.Mode = fuse.S_IFDIR
+		}
+		ret_dirs = append(ret_dirs, val)
+
+		// Cache some stuff
+		CSet("Lookup:"+val.Name+":in:"+google_id+":id", n.GoogleId)
+		CSet("Lookup:"+val.Name+":in:"+google_id+":isDir", n.IsDir())
+		// "Preload" some stuff to make things quicker
+		if OPENDIR_AUTO_CACHE_FOR_GETBASICS {
+			if !BasicsKnown(file.Id) {
+				DriveGetBasicsPutFile(file)
+				Log.DebugF("Preloaded %s (%s)", file.Id, file.Name)
 			}
 		}
-		// Save cache
-		CSet("OpenDir:"+google_id, ret_dirs)
-		CSet("OpenDir:"+google_id+":!ret", fuse.OK)
-		CSet("OpenDir:"+google_id+":!RefrehTime", time.Now().Add(OPENDIR_REFRESH_DELTA).Unix())
-		ret_code = fuse.OK
+	}
+	// Tell the kernel what changed since the last time
+	if CFound("OpenDir:" + google_id) {
+		var old_dirs []fuse.DirEntry
+		CGet("OpenDir:"+google_id, &old_dirs)
+		DriveOpenDirNotify(google_id, old_dirs, ret_dirs)
+	}
+	// Save cache
+	DriveOpenDirPut(google_id, ret_dirs)
+	ret_code = fuse.OK
+	return
+}
+
+// Saves a complete listing of google_id.
+func DriveOpenDirPut(google_id string, dirs []fuse.DirEntry) {
+	CSet("OpenDir:"+google_id, dirs)
+	CSet("OpenDir:"+google_id+":!ret", fuse.OK)
+	CSet("OpenDir:"+google_id+":!RefrehTime", time.Now().Add(OPENDIR_REFRESH_DELTA).Unix())
+}
+
+func DriveOpenDirConsumerCoreBody() {
+}
+
+// Adds a locally created file to the cached listing of parent_id so it shows up before the next refresh.
+func DriveOpenDirAdd(parent_id, name, google_id string, isDir bool) {
+	CSet("Lookup:"+name+":in:"+parent_id+":id", google_id)
+	CSet("Lookup:"+name+":in:"+parent_id+":isDir", isDir)
+
+	CLock("OpenDir:" + parent_id + ":!mux")
+	defer CUnlock("OpenDir:" + parent_id + ":!mux")
+	if !CFound("OpenDir:" + parent_id) {
 		return
-	} else {
-		CSet("OpenDir:"+google_id+":!ret", fuse.ENODATA)
-		ret_code = fuse.ENODATA
+	}
+	var dirs []fuse.DirEntry
+	CGet("OpenDir:"+parent_id, &dirs)
+	for _, entry := range dirs {
+		if entry.Name == name {
+			return
+		}
+	}
+	val := fuse.DirEntry{}
+	val.Name = name
+	if isDir {
+		val.Mode = fuse.S_IFDIR
+	}
+	dirs = append(dirs, val)
+	CSet("OpenDir:"+parent_id, dirs)
+}
+
+// Removes name from the cached listing of parent_id so it disappears before the next refresh.
+func DriveOpenDirRemove(parent_id, name string) {
+	CDel("Lookup:"+name+":in:"+parent_id+":id", "Lookup:"+name+":in:"+parent_id+":isDir")
+
+	CLock("OpenDir:" + parent_id + ":!mux")
+	defer CUnlock("OpenDir:" + parent_id + ":!mux")
+	if !CFound("OpenDir:" + parent_id) {
 		return
 	}
+	var dirs []fuse.DirEntry
+	CGet("OpenDir:"+parent_id, &dirs)
+	for i, entry := range dirs {
+		if entry.Name == name {
+			dirs = append(dirs[:i], dirs[i+1:]...)
+			CSet("OpenDir:"+parent_id, dirs)
+			return
+		}
+	}
 }
 
-func DriveOpenDirConsumerCoreBody() {
+// Tells the kernel about names that were added to or removed from the listing of google_id.
+func DriveOpenDirNotify(google_id string, old_dirs, new_dirs []fuse.DirEntry) {
+	old_names := make(map[string]bool)
+	for _, entry := range old_dirs {
+		old_names[entry.Name] = true
+	}
+	for _, entry := range new_dirs {
+		if !old_names[entry.Name] {
+			NotifyEntry(google_id, entry.Name)
+		}
+		delete(old_names, entry.Name)
+	}
+	for name := range old_names {
+		NotifyDelete(google_id, name)
+	}
+}
+
+// Makes DriveOpenDir load parent_id again (and wait for it) the next time it is used.
+func DriveOpenDirExpire(parent_id string) {
+	CDel("OpenDir:" + parent_id + ":!RefrehTime")
+}
+
+// Removes whatever name google_id has in the cached listing of parent_id and returns the names removed.
+func DriveOpenDirRemoveId(parent_id, google_id string) []string {
+	var dirs []fuse.DirEntry
+	CGet("OpenDir:"+parent_id, &dirs)
+	names := make([]string, 0)
+	for _, entry := range dirs {
+		if CGet_str("Lookup:"+entry.Name+":in:"+parent_id+":id") == google_id {
+			DriveOpenDirRemove(parent_id, entry.Name)
+			names = append(names, entry.Name)
+		}
+	}
+	return names
+}
+
+// Moves an entry from the cached listing of old_parent to the one of new_parent. Both listings are saved in a single transaction.
+func DriveOpenDirMove(old_parent, old_name, new_parent, new_name, google_id string, isDir bool) {
+	// Always lock in the same order to avoid deadlocks
+	first, second := old_parent, new_parent
+	if first > second {
+		first, second = second, first
+	}
+	CLock("OpenDir:" + first + ":!mux")
+	defer CUnlock("OpenDir:" + first + ":!mux")
+	if first != second {
+		CLock("OpenDir:" + second + ":!mux")
+		defer CUnlock("OpenDir:" + second + ":!mux")
+	}
+
+	set := make(map[string]interface{})
+	set["Lookup:"+new_name+":in:"+new_parent+":id"] = google_id
+	set["Lookup:"+new_name+":in:"+new_parent+":isDir"] = isDir
+	del := []string{"Lookup:" + old_name + ":in:" + old_parent + ":id", "Lookup:" + old_name + ":in:" + old_parent + ":isDir"}
+
+	// Remove from the old listing
+	var old_dirs []fuse.DirEntry
+	if CFound("OpenDir:" + old_parent) {
+		CGet("OpenDir:"+old_parent, &old_dirs)
+		for i, entry := range old_dirs {
+			if entry.Name == old_name {
+				old_dirs = append(old_dirs[:i], old_dirs[i+1:]...)
+				break
+			}
+		}
+		set["OpenDir:"+old_parent] = old_dirs
+	}
+	// Add to the new one
+	if CFound("OpenDir:" + new_parent) {
+		var new_dirs []fuse.DirEntry
+		if new_parent == old_parent {
+			new_dirs = old_dirs
+		} else {
+			CGet("OpenDir:"+new_parent, &new_dirs)
+		}
+		val := fuse.DirEntry{}
+		val.Name = new_name
+		if isDir {
+			val.Mode = fuse.S_IFDIR
+		}
+		new_dirs = append(new_dirs, val)
+		set["OpenDir:"+new_parent] = new_dirs
+	}
+	CApply(set, del...)
 }
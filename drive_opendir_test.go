@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func dir_entry_names(dirs []fuse.DirEntry) string {
+	names := make([]string, 0)
+	for _, entry := range dirs {
+		if entry.Mode&fuse.S_IFDIR != 0 {
+			names = append(names, entry.Name+"/")
+		} else {
+			names = append(names, entry.Name)
+		}
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+func TestDriveOpenDirConsumerCore(t *testing.T) {
+	b := fake_drive_env(t)
+	folder := b.Put("root", "folder", MimeTypeGoogleFolder, nil)
+	hello := b.Put("root", "hello.txt", "text/plain", []byte("hello"))
+	b.Put("root", "a/b", "text/plain", nil)
+	first := b.Put(folder.Id, "same.txt", "text/plain", []byte("1"))
+	second := b.Put(folder.Id, "same.txt", "text/plain", []byte("2"))
+
+	dirs, code, skip := DriveOpenDirConsumerCore(b, "root")
+	if code != fuse.OK || skip {
+		t.Fatalf("Listing root returned %v (skip=%v)", code, skip)
+	}
+	expected := fmt.Sprint([]string{DriveSanitizeName("a/b", "text/plain"), "folder/", "hello.txt"})
+	if got := dir_entry_names(dirs); got != expected {
+		t.Errorf("Listing root returned %s instead of %s", got, expected)
+	}
+	// What DriveOpenDir and Lookup use
+	cached, code := DriveOpenDir("root")
+	if code != fuse.OK || dir_entry_names(cached) != expected {
+		t.Errorf("DriveOpenDir returned %s (%v) instead of %s", dir_entry_names(cached), code, expected)
+	}
+	if id := CGet_str("Lookup:hello.txt:in:root:id"); id != hello.Id {
+		t.Errorf("hello.txt is %q instead of %q", id, hello.Id)
+	}
+	if rec, found := BasicsGet(hello.Id); !found || rec.Size != 5 || rec.MD5 != hello.Md5Checksum {
+		t.Errorf("The basics of hello.txt were not preloaded: %+v", rec)
+	}
+
+	// Files with the same name get their ids in the name
+	dirs, code, _ = DriveOpenDirConsumerCore(b, folder.Id)
+	expected = fmt.Sprint([]string{
+		DriveUnambiguousName(first.Id, first.Name, first.MimeType),
+		DriveUnambiguousName(second.Id, second.Name, second.MimeType),
+	})
+	if got := dir_entry_names(dirs); code != fuse.OK || got != expected {
+		t.Errorf("Listing folder returned %s (%v) instead of %s", got, code, expected)
+	}
+
+	// Files removed on Google Drive go away on the next listing
+	b.Delete(hello.Id, false)
+	dirs, code, _ = DriveOpenDirConsumerCore(b, "root")
+	expected = fmt.Sprint([]string{DriveSanitizeName("a/b", "text/plain"), "folder/"})
+	if got := dir_entry_names(dirs); code != fuse.OK || got != expected {
+		t.Errorf("Listing root after a removal returned %s (%v) instead of %s", got, code, expected)
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -13,11 +18,78 @@ const READ_REFRESH_DELTA = 3 * time.Minute
 const READ_CACHE_ENABLE = true
 const READ_PRELOAD_ENABLE = false
 
+// How many times a file is downloaded before giving up on it not matching its MD5.
+const READ_VERIFY_TRIES = 3
+
+// Regular files are read through DriveReadRange, which only downloads the blocks that are read. If zero (-read-blocks=false), they are downloaded whole and read through DriveReadStream as the bytes arrive, like exported files. Use ReadBlocks and SetReadBlocks as it is read by every Read.
+var read_blocks int32 = 1
+
+func ReadBlocks() bool {
+	return atomic.LoadInt32(&read_blocks) != 0
+}
+
+func SetReadBlocks(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&read_blocks, v)
+}
+
 var ChReadReq = make(chan string, 64)
 var ChReadReqLP = make(chan string, 64)
 var MapReadAns = make(map[string][]*sync.Mutex)
 var MapReadAnsMux = new(sync.RWMutex)
 
+// Tells DriveReadStream how much of a file DriveReadConsumerCore has already saved. Every ReadProgress uses MapReadProgressMux as its lock.
+type ReadProgress struct {
+	cond    *sync.Cond
+	users   int
+	running bool
+	done    bool
+	path    string
+	written int64
+}
+
+var MapReadProgress = make(map[string]*ReadProgress)
+var MapReadProgressMux = new(sync.Mutex)
+
+func read_progress_acquire(google_id string) *ReadProgress {
+	MapReadProgressMux.Lock()
+	defer MapReadProgressMux.Unlock()
+	p, ok := MapReadProgress[google_id]
+	if !ok {
+		p = &ReadProgress{cond: sync.NewCond(MapReadProgressMux)}
+		MapReadProgress[google_id] = p
+	}
+	p.users++
+	return p
+}
+
+func read_progress_release(google_id string, p *ReadProgress) {
+	MapReadProgressMux.Lock()
+	defer MapReadProgressMux.Unlock()
+	p.users--
+	if p.users <= 0 && MapReadProgress[google_id] == p {
+		delete(MapReadProgress, google_id)
+	}
+}
+
+// Wakes up every DriveReadStream waiting on a file as its bytes are saved.
+type read_progress_writer struct {
+	w io.Writer
+	p *ReadProgress
+}
+
+func (pw read_progress_writer) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	MapReadProgressMux.Lock()
+	pw.p.written += int64(n)
+	pw.p.cond.Broadcast()
+	MapReadProgressMux.Unlock()
+	return n, err
+}
+
 // Adds the desired file id to ChReadReqLP if it is not full. Otherwise, nothing happens.
 func DriveReadPreload(google_id string) {
 	if READ_PRELOAD_ENABLE {
@@ -49,6 +121,42 @@ func DriveRead(google_id string) fuse.Status {
 	return status
 }
 
+// Like DriveRead, but returns as soon as the bytes [off, off+size) were saved, even if the rest of the file is still being downloaded. The returned path is where they can be read from.
+func DriveReadStream(google_id string, off int64, size int) (string, fuse.Status) {
+	p := read_progress_acquire(google_id)
+	defer read_progress_release(google_id, p)
+	MapReadProgressMux.Lock()
+	if !p.running {
+		p.done = false
+	}
+	MapReadProgressMux.Unlock()
+
+	// Ask for the file, but do not wait for all of it
+	go func() {
+		DriveRead(google_id)
+		MapReadProgressMux.Lock()
+		if !p.running {
+			p.done = true
+			p.cond.Broadcast()
+		}
+		MapReadProgressMux.Unlock()
+	}()
+
+	MapReadProgressMux.Lock()
+	for !p.done && (!p.running || p.written < off+int64(size)) {
+		p.cond.Wait()
+	}
+	ready := !p.done
+	path := p.path
+	MapReadProgressMux.Unlock()
+	if ready {
+		return path, fuse.OK
+	}
+	var status fuse.Status
+	CGet("Read:"+google_id+":!ret", &status)
+	return CacheDir + google_id, status
+}
+
 func file_mtime(path string) (mtime int64) {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -58,7 +166,26 @@ func file_mtime(path string) (mtime int64) {
 	return
 }
 
-func DriveReadConsumer() {
+// Tells whether the cached copy of google_id is missing or older than the one on Google Drive.
+func DriveReadNeedsDownload(google_id string) bool {
+	// Refresh file if the server version is newer
+	rec, _ := BasicsGet(google_id)
+	cloud_mtime := int64(rec.Mtime)
+	local_mtime := file_mtime(CacheDir + google_id)
+	flag_refresh := cloud_mtime > local_mtime || cloud_mtime == 0 || local_mtime == 0
+	// Some changes do not touch the mtime
+	cloud_md5 := rec.MD5
+	local_md5 := CGet_str("Read:" + google_id + ":!MD5")
+	flag_refresh = flag_refresh || (cloud_md5 != "" && local_md5 != "" && cloud_md5 != local_md5)
+	// Also refresh exported files saved in another format
+	export_mime, _ := DriveExportMimeType(rec.MimeType)
+	flag_refresh = flag_refresh || CGet_str("Read:"+google_id+":!ExportAs") != export_mime
+	// Never overwrite local changes that were not uploaded yet
+	flag_pending := JournalPending(google_id) && local_mtime != 0
+	return !flag_pending && (flag_refresh || !CFound("Read:"+google_id+":!ret") || READ_CACHE_ENABLE == false)
+}
+
+func DriveReadConsumer(backend DriveBackend) {
 	Log.Notice("DriveReadConsumer: Started")
 	for {
 		google_id := ""
@@ -76,12 +203,8 @@ func DriveReadConsumer() {
 			Log.DebugF("DriveReadConsumer: Skipping %s", google_id)
 			continue
 		}
-		// Refresh file if the server version is newer
-		cloud_mtime := CGetDef_int64("BasicAttr:"+google_id+":Mtime", 0)
-		local_mtime := file_mtime(CacheDir + google_id)
-		flag_refresh := cloud_mtime > local_mtime || cloud_mtime == 0 || local_mtime == 0
-		if flag_refresh || !CFound("Read:"+google_id+":!ret") || READ_CACHE_ENABLE == false {
-			DriveReadConsumerCore(google_id)
+		if DriveReadNeedsDownload(google_id) {
+			DriveReadConsumerCore(backend, google_id)
 		}
 		// Unlock answer mutexes
 		MapReadAnsMux.Lock()
@@ -95,7 +218,7 @@ func DriveReadConsumer() {
 	}
 }
 
-func DriveReadConsumerCore(google_id string) (ret_code fuse.Status) {
+func DriveReadConsumerCore(backend DriveBackend, google_id string) (ret_code fuse.Status) {
 	// Save ourselves
 	defer func() {
 		if r := recover(); r != nil {
@@ -108,34 +231,122 @@ func DriveReadConsumerCore(google_id string) (ret_code fuse.Status) {
 	defer PrintCallDuration("DriveReadConsumerCore", &_start)
 	Log.InfoF("DriveReadConsumerCore: Loading %s from the Internet", google_id)
 
-	CSet("Read:"+google_id+":!ret", fuse.EIO)
 	CSet("Read:"+google_id+":!working", true)
 	defer CSet("Read:"+google_id+":!working", false)
+	// Let DriveReadStream follow the download
+	p := read_progress_acquire(google_id)
+	defer read_progress_release(google_id, p)
+	MapReadProgressMux.Lock()
+	p.running = true
+	p.done = false
+	p.written = 0
+	MapReadProgressMux.Unlock()
+	defer func() {
+		MapReadProgressMux.Lock()
+		p.running = false
+		p.done = true
+		p.cond.Broadcast()
+		MapReadProgressMux.Unlock()
+	}()
+	// Keep DriveReadRange away while the file is rewritten
+	CLock("Block:" + google_id + ":!mux")
+	defer CUnlock("Block:" + google_id + ":!mux")
 
-	// Download file
+	// Download file, trying again if it does not match the MD5 Google Drive told us
 	now := time.Now().Unix()
 	CSet("Read:"+google_id+":!Mtime", now)
-	r, err := DriveClient.Files.Get(google_id).Download()
+	rec, _ := BasicsGet(google_id)
+	export_mime, export := DriveExportMimeType(rec.MimeType)
+	cloud_md5 := rec.MD5
+	var size int64
+	for try := 1; ; try++ {
+		var tmp_path, sum string
+		var sts fuse.Status
+		tmp_path, size, sum, sts = drive_read_download(backend, google_id, export_mime, export, p)
+		if sts != fuse.OK {
+			return sts
+		}
+		// Exported files have no MD5
+		if export || cloud_md5 == "" || sum == cloud_md5 {
+			// Files that are open keep the old content until they are opened again
+			if err := os.Rename(tmp_path, CacheDir+google_id); err != nil {
+				Log.ErrorF("Unable to Read %s: %v", google_id, err)
+				os.Remove(tmp_path)
+				return fuse.EIO
+			}
+			break
+		}
+		os.Remove(tmp_path)
+		// Streaming reads may have been served the bad bytes already, so make the kernel forget what it cached
+		NotifyFile(google_id)
+		if try >= READ_VERIFY_TRIES {
+			Log.ErrorF("Unable to Read %s: got MD5 %s instead of %s %d times", google_id, sum, cloud_md5, try)
+			CSet("Read:"+google_id+":!ret", fuse.EIO)
+			return fuse.EIO
+		}
+		Log.WarningF("DriveReadConsumerCore: Got MD5 %s instead of %s for %s, trying again", sum, cloud_md5, google_id)
+	}
+	// Google Drive does not know how big an exported file is
+	if export {
+		BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.Size = uint64(size) })
+	}
+	CSet("Read:"+google_id+":!ExportAs", export_mime)
+	// Remember which version we got so uploads can detect conflicts
+	CSet("Read:"+google_id+":!MD5", cloud_md5)
+	CSet("Read:"+google_id+":!Revision", rec.Revision)
+
+	Log.InfoF("DriveReadConsumerCore: SAVED %s from the Internet on %s", google_id, CacheDir+google_id)
+	CSet("Read:"+google_id+":!ret", fuse.OK)
+	CDelPrefix("Block:" + google_id + ":")
+	CacheTouch(google_id)
+	CacheEvictRequest()
+	return fuse.OK
+}
+
+// Downloads (or exports) google_id onto a temporary file and returns its path, size and MD5. It is up to the caller to move it to CacheDir+google_id.
+func drive_read_download(backend DriveBackend, google_id, export_mime string, export bool, p *ReadProgress) (string, int64, string, fuse.Status) {
+	// Google-native files can only be exported
+	var body io.ReadCloser
+	var err error
+	if export {
+		body, err = backend.Export(google_id, export_mime)
+	} else {
+		body, _, err = backend.Download(google_id, 0, -1)
+	}
 	if err != nil {
 		Log.ErrorF("Unable to Read %s: %v", google_id, err)
-		return fuse.EIO
+		if !CFound("Read:" + google_id + ":!ret") {
+			CSet("Read:"+google_id+":!ret", fuse.EIO)
+		}
+		return "", 0, "", fuse.EIO
 	}
+	defer body.Close()
 	Log.InfoF("DriveReadConsumerCore: LOADED %s from the Internet", google_id)
-	// Open file
-	w, err := os.OpenFile(CacheDir+google_id, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// Open file (the previous copy, if any, is still good)
+	w, err := ioutil.TempFile(PathInCache("tmp"), google_id+"-")
 	if err != nil {
 		Log.ErrorF("Unable to Read %s: %v", google_id, err)
-		return fuse.EIO
+		return "", 0, "", fuse.EIO
 	}
+	defer w.Close()
+	if err := w.Chmod(0644); err != nil {
+		Log.WarningF("Failed to chmod %s: %v", w.Name(), err)
+	}
+	MapReadProgressMux.Lock()
+	p.path = w.Name()
+	p.written = 0
+	MapReadProgressMux.Unlock()
 	// Save file
-	buf := bufio.NewReader(r.Body)
-	_, err = buf.WriteTo(w)
+	hash := md5.New()
+	buf := bufio.NewReader(body)
+	size, err := buf.WriteTo(io.MultiWriter(read_progress_writer{w, p}, hash))
+	if err == nil {
+		err = w.Sync()
+	}
 	if err != nil {
 		Log.ErrorF("Unable to Read %s: %v", google_id, err)
-		return fuse.EIO
+		os.Remove(w.Name())
+		return "", 0, "", fuse.EIO
 	}
-
-	Log.InfoF("DriveReadConsumerCore: SAVED %s from the Internet on %s", google_id, CacheDir+google_id)
-	CSet("Read:"+google_id+":!ret", fuse.OK)
-	return fuse.OK
+	return w.Name(), size, hex.EncodeToString(hash.Sum(nil)), fuse.OK
 }
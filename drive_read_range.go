@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const READ_BLOCK_SIZE = 1024 * 1024
+
+// Files that are only partially read are kept as sparse files on CacheDir. "Block:<id>:!bitmap" tells which READ_BLOCK_SIZE blocks were already downloaded and "Block:<id>:!MD5"/"Block:<id>:!Mtime" tell which version of the file they came from. Once every block is there, the file is handled just like one downloaded by DriveReadConsumerCore and the Block keys are dropped.
+
+func block_count(size int64) int64 {
+	return (size + READ_BLOCK_SIZE - 1) / READ_BLOCK_SIZE
+}
+
+func block_has(bitmap []byte, block int64) bool {
+	return bitmap[block/8]&(1<<uint(block%8)) != 0
+}
+
+func block_set(bitmap []byte, block int64) {
+	bitmap[block/8] |= 1 << uint(block%8)
+}
+
+// Ensures the bytes [off, off+size) of google_id are on CacheDir+google_id, downloading only the blocks that are missing.
+func DriveReadRange(backend DriveBackend, google_id string, off int64, size int) (ret_code fuse.Status) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_code = fuse.EIO
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("DriveReadRange", &_start)
+
+	if sts := DriveGetBasics(google_id); sts != fuse.OK {
+		return sts
+	}
+	CLock("Block:" + google_id + ":!mux")
+	defer CUnlock("Block:" + google_id + ":!mux")
+	if !DriveReadNeedsDownload(google_id) {
+		return fuse.OK
+	}
+
+	// Start over if the blocks we have belong to another version
+	rec, _ := BasicsGet(google_id)
+	file_size := int64(rec.Size)
+	cloud_md5 := rec.MD5
+	cloud_mtime := int64(rec.Mtime)
+	bitmap := CGet_bytes("Block:" + google_id + ":!bitmap")
+	fresh_start := len(bitmap) != int((block_count(file_size)+7)/8) ||
+		CGet_str("Block:"+google_id+":!MD5") != cloud_md5 ||
+		CGetDef_int64("Block:"+google_id+":!Mtime", 0) != cloud_mtime
+	if fresh_start {
+		Log.DebugF("DriveReadRange: Starting a new block set for %s", google_id)
+		// Files that are open keep the old content until they are opened again
+		if err := os.Remove(CacheDir + google_id); err != nil && !os.IsNotExist(err) {
+			Log.ErrorF("Unable to Read %s: %v", google_id, err)
+			return fuse.EIO
+		}
+		bitmap = make([]byte, (block_count(file_size)+7)/8)
+		CApply(map[string]interface{}{
+			"Block:" + google_id + ":!bitmap": bitmap,
+			"Block:" + google_id + ":!MD5":    cloud_md5,
+			"Block:" + google_id + ":!Mtime":  cloud_mtime,
+		}, "Read:"+google_id+":!ret")
+	}
+
+	// Open (or create) the sparse file
+	w, err := os.OpenFile(CacheDir+google_id, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		Log.ErrorF("Unable to Read %s: %v", google_id, err)
+		return fuse.EIO
+	}
+	defer w.Close()
+	if fresh_start {
+		if err := w.Truncate(file_size); err != nil {
+			Log.ErrorF("Unable to Read %s: %v", google_id, err)
+			return fuse.EIO
+		}
+	}
+
+	// Download every run of missing blocks
+	if off < file_size && size > 0 {
+		first := off / READ_BLOCK_SIZE
+		last := (off + int64(size) - 1) / READ_BLOCK_SIZE
+		if last >= block_count(file_size) {
+			last = block_count(file_size) - 1
+		}
+		for block := first; block <= last; block++ {
+			if block_has(bitmap, block) {
+				continue
+			}
+			end := block
+			for end+1 <= last && !block_has(bitmap, end+1) {
+				end++
+			}
+			got_all, err := drive_read_blocks(backend, google_id, w, block, end, file_size)
+			if err != nil {
+				Log.ErrorF("Unable to Read %s: %v", google_id, err)
+				return fuse.EIO
+			}
+			if got_all {
+				end = block_count(file_size) - 1
+				block = 0
+			}
+			for i := block; i <= end; i++ {
+				block_set(bitmap, i)
+			}
+			CSet_bytes("Block:"+google_id+":!bitmap", bitmap)
+			block = end
+		}
+	}
+
+	// Nothing is missing anymore
+	for block := int64(0); block < block_count(file_size); block++ {
+		if !block_has(bitmap, block) {
+			CacheTouch(google_id)
+			CacheEvictRequest()
+			return fuse.OK
+		}
+	}
+	if sum, err := file_md5(CacheDir + google_id); err != nil || (cloud_md5 != "" && sum != cloud_md5) {
+		// Blocks can not be checked one by one, so readers may have got bad bytes already. Have the kernel forget them and download the whole file instead, just like DriveReadConsumerCore.
+		Log.WarningF("DriveReadRange: Got MD5 %s instead of %s (%v) for %s, downloading it whole", sum, cloud_md5, err, google_id)
+		NotifyFile(google_id)
+		CDelPrefix("Block:" + google_id + ":")
+		if sts := drive_read_range_verify(backend, google_id, cloud_md5); sts != fuse.OK {
+			return sts
+		}
+	}
+	Log.InfoF("DriveReadRange: SAVED all blocks of %s from the Internet on %s", google_id, CacheDir+google_id)
+	CApply(map[string]interface{}{
+		"Read:" + google_id + ":!Mtime":    time.Now().Unix(),
+		"Read:" + google_id + ":!ExportAs": "",
+		"Read:" + google_id + ":!MD5":      cloud_md5,
+		"Read:" + google_id + ":!Revision": rec.Revision,
+		"Read:" + google_id + ":!ret":      fuse.OK,
+	})
+	CDelPrefix("Block:" + google_id + ":")
+	CacheTouch(google_id)
+	CacheEvictRequest()
+	return fuse.OK
+}
+
+// Downloads google_id whole until it matches cloud_md5, READ_VERIFY_TRIES times at most counting the blocks that did not match.
+func drive_read_range_verify(backend DriveBackend, google_id, cloud_md5 string) fuse.Status {
+	// Nobody follows this download
+	p := &ReadProgress{cond: sync.NewCond(MapReadProgressMux)}
+	for try := 2; ; try++ {
+		tmp_path, _, sum, sts := drive_read_download(backend, google_id, "", false, p)
+		if sts != fuse.OK {
+			os.Remove(CacheDir + google_id)
+			return sts
+		}
+		if sum == cloud_md5 {
+			if err := os.Rename(tmp_path, CacheDir+google_id); err != nil {
+				Log.ErrorF("Unable to Read %s: %v", google_id, err)
+				os.Remove(tmp_path)
+				os.Remove(CacheDir + google_id)
+				return fuse.EIO
+			}
+			return fuse.OK
+		}
+		os.Remove(tmp_path)
+		if try >= READ_VERIFY_TRIES {
+			Log.ErrorF("Unable to Read %s: got MD5 %s instead of %s %d times", google_id, sum, cloud_md5, try)
+			os.Remove(CacheDir + google_id)
+			CSet("Read:"+google_id+":!ret", fuse.EIO)
+			return fuse.EIO
+		}
+		Log.WarningF("DriveReadRange: Got MD5 %s instead of %s for %s, trying again", sum, cloud_md5, google_id)
+	}
+}
+
+// Downloads blocks first to last (inclusive) of google_id into w. If Google Drive ignores the Range header the whole file is saved and got_all is true.
+func drive_read_blocks(backend DriveBackend, google_id string, w *os.File, first, last, file_size int64) (got_all bool, err error) {
+	start := first * READ_BLOCK_SIZE
+	end := (last+1)*READ_BLOCK_SIZE - 1
+	if end >= file_size {
+		end = file_size - 1
+	}
+	Log.InfoF("DriveReadRange: Loading bytes %d-%d of %s from the Internet", start, end, google_id)
+
+	body, partial, err := backend.Download(google_id, start, end)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	if !partial {
+		start = 0
+		end = file_size - 1
+		got_all = true
+	}
+	if _, err := w.Seek(start, io.SeekStart); err != nil {
+		return false, err
+	}
+	if _, err := io.CopyN(w, body, end-start+1); err != nil {
+		return false, err
+	}
+	return got_all, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestDriveGetBasicsConsumerCore(t *testing.T) {
+	b := fake_drive_env(t)
+	file := b.Put("root", "hello.txt", "text/plain", []byte("hello"))
+	if code := DriveGetBasicsConsumerCore(b, file.Id); code != fuse.OK {
+		t.Fatalf("DriveGetBasicsConsumerCore returned %v", code)
+	}
+	rec, found := BasicsGet(file.Id)
+	if !found || rec.Name != "hello.txt" || rec.Size != 5 || rec.MD5 != file.Md5Checksum || rec.Revision != file.HeadRevisionId {
+		t.Errorf("Got %+v for %+v", rec, file)
+	}
+	if rec.Mtime != uint64(FAKE_DRIVE_TEST_TIME.Unix()) {
+		t.Errorf("mtime is %d instead of %d", rec.Mtime, FAKE_DRIVE_TEST_TIME.Unix())
+	}
+	if code := DriveGetBasicsConsumerCore(b, "missing"); code != fuse.EIO {
+		t.Errorf("Loading a missing file returned %v instead of EIO", code)
+	}
+}
+
+func TestDriveReadConsumerCore(t *testing.T) {
+	b := fake_drive_env(t)
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	file := b.Put("root", "digits.txt", "text/plain", content)
+	doc := b.Put("root", "doc", MimeTypeGoogleDocument, []byte("exported"))
+	for _, id := range []string{file.Id, doc.Id} {
+		if code := DriveGetBasicsConsumerCore(b, id); code != fuse.OK {
+			t.Fatalf("DriveGetBasicsConsumerCore(%s) returned %v", id, code)
+		}
+	}
+
+	if code := DriveReadConsumerCore(b, file.Id); code != fuse.OK {
+		t.Fatalf("DriveReadConsumerCore returned %v", code)
+	}
+	if got, err := ioutil.ReadFile(CacheDir + file.Id); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Got %d bytes (%v) that differ from the %d on the fake Drive", len(got), err, len(content))
+	}
+	if DriveReadNeedsDownload(file.Id) {
+		t.Errorf("%s must be downloaded again right after it was downloaded", file.Id)
+	}
+
+	// Exported files get their size once they are downloaded
+	if code := DriveReadConsumerCore(b, doc.Id); code != fuse.OK {
+		t.Fatalf("DriveReadConsumerCore returned %v for a Google Doc", code)
+	}
+	if got, _ := ioutil.ReadFile(CacheDir + doc.Id); string(got) != "exported" {
+		t.Errorf("Got %q instead of the exported Google Doc", got)
+	}
+	if rec, _ := BasicsGet(doc.Id); rec.Size != uint64(len("exported")) {
+		t.Errorf("The Google Doc has size %d instead of %d", rec.Size, len("exported"))
+	}
+
+	// Downloads that never match the MD5 are given up on
+	BasicsUpdate(file.Id, func(rec *BasicsRecord) { rec.MD5 = "0123456789abcdef0123456789abcdef" })
+	if code := DriveReadConsumerCore(b, file.Id); code != fuse.EIO {
+		t.Errorf("DriveReadConsumerCore returned %v instead of EIO for a bad MD5", code)
+	}
+}
+
+func TestDriveReadRangeVerify(t *testing.T) {
+	b := fake_drive_env(t)
+	content := make([]byte, 2*READ_BLOCK_SIZE)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	file := b.Put("root", "big.bin", "application/octet-stream", content)
+	if code := DriveGetBasicsConsumerCore(b, file.Id); code != fuse.OK {
+		t.Fatalf("DriveGetBasicsConsumerCore returned %v", code)
+	}
+	if code := DriveReadRange(b, file.Id, 0, 10); code != fuse.OK {
+		t.Fatalf("DriveReadRange returned %v for the first block", code)
+	}
+
+	// A block that went bad is noticed once the last one is there, and the whole file is downloaded instead
+	f, err := os.OpenFile(CacheDir+file.Id, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.WriteAt([]byte("bad"), 0)
+	f.Close()
+	if code := DriveReadRange(b, file.Id, READ_BLOCK_SIZE, 10); code != fuse.OK {
+		t.Fatalf("DriveReadRange returned %v for the last block", code)
+	}
+	if got, _ := ioutil.ReadFile(CacheDir + file.Id); !bytes.Equal(got, content) {
+		t.Errorf("The bad block was kept")
+	}
+
+	// Files that never match are given up on
+	other := b.Put("root", "other.bin", "application/octet-stream", content[:10])
+	DriveGetBasicsConsumerCore(b, other.Id)
+	BasicsUpdate(other.Id, func(rec *BasicsRecord) { rec.MD5 = "0123456789abcdef0123456789abcdef" })
+	if code := DriveReadRange(b, other.Id, 0, 10); code != fuse.EIO {
+		t.Errorf("DriveReadRange returned %v instead of EIO for a bad MD5", code)
+	}
+	if _, err := os.Stat(CacheDir + other.Id); !os.IsNotExist(err) {
+		t.Errorf("The bad copy was kept (%v)", err)
+	}
+}
+
+func TestCacheVerifyTree(t *testing.T) {
+	b := fake_drive_env(t)
+	folder := b.Put("root", "folder", MimeTypeGoogleFolder, nil)
+	inside := b.Put(folder.Id, "inside.txt", "text/plain", []byte("inside"))
+	outside := b.Put("root", "outside.txt", "text/plain", []byte("outside"))
+	for _, id := range []string{"root", folder.Id} {
+		DriveOpenDirConsumerCore(b, id)
+	}
+	for _, id := range []string{inside.Id, outside.Id} {
+		if code := DriveReadConsumerCore(b, id); code != fuse.OK {
+			t.Fatalf("DriveReadConsumerCore returned %v", code)
+		}
+		ioutil.WriteFile(CacheDir+id, []byte("corrupt"), 0644)
+	}
+
+	CacheVerifyTree(folder.Id)
+	if _, err := os.Stat(CacheDir + inside.Id); !os.IsNotExist(err) {
+		t.Errorf("The bad copy inside the folder was kept (%v)", err)
+	}
+	if _, err := os.Stat(CacheDir + outside.Id); err != nil {
+		t.Errorf("The copy outside the folder was checked too (%v)", err)
+	}
+}
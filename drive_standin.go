@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const STANDIN_LIST_PAGE_SIZE = 100
+
+// Files with these extensions are served as Google-native files. Their content is what Files.Export returns.
+var StandInNativeExts = map[string]string{
+	".gdoc":    MimeTypeGoogleDocument,
+	".gsheet":  MimeTypeGoogleSpreadsheet,
+	".gslides": MimeTypeGooglePresentation,
+	".gdraw":   MimeTypeGoogleDrawing,
+}
+
+// DriveStandIn answers the part of the Drive v3 REST API that MegaDrive uses (files.get, files.list, alt=media downloads with Range, files.export, files.generateIds, uploads, files.update, files.delete and changes.list), so the real drive/v3 client can be used without network access. It starts with the files of a local folder; changes made through it are kept in memory and never written back.
+type DriveStandIn struct {
+	backend     *FakeDriveBackend
+	uploads     map[string]*standin_upload
+	next_upload int
+	mux         *sync.Mutex
+}
+
+// A resumable upload that was started but not finished yet.
+type standin_upload struct {
+	google_id     string // Empty when creating a file
+	file          *drive.File
+	add_parent    string
+	remove_parent string
+	content       bytes.Buffer
+}
+
+// Loads every file and folder inside dir, which becomes "root".
+func NewDriveStandIn(dir string) (*DriveStandIn, error) {
+	s := &DriveStandIn{
+		backend: NewFakeDriveBackend(),
+		uploads: make(map[string]*standin_upload),
+		mux:     new(sync.Mutex),
+	}
+	dir = filepath.Clean(dir)
+	ids := map[string]string{dir: s.backend.RootId()}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		parent_id := ids[filepath.Dir(path)]
+		// Keep the real mtimes
+		s.backend.Now = info.ModTime
+		switch {
+		case info.IsDir():
+			ids[path] = s.backend.Put(parent_id, info.Name(), MimeTypeGoogleFolder, nil).Id
+		case info.Mode().IsRegular():
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			name, mime_type := standin_mime_type(info.Name())
+			s.backend.Put(parent_id, name, mime_type, content)
+		}
+		return nil
+	})
+	s.backend.Now = time.Now
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Starts a DriveStandIn for dir on a local port. Give server.URL+"/drive/v3/" to GetDriveClient.
+func NewDriveStandInServer(dir string) (*httptest.Server, error) {
+	s, err := NewDriveStandIn(dir)
+	if err != nil {
+		return nil, err
+	}
+	return httptest.NewServer(s), nil
+}
+
+// The fake Drive the requests are answered from.
+func (s *DriveStandIn) Backend() *FakeDriveBackend {
+	return s.backend
+}
+
+func standin_mime_type(name string) (string, string) {
+	ext := filepath.Ext(name)
+	if mime_type, ok := StandInNativeExts[ext]; ok {
+		return strings.TrimSuffix(name, ext), mime_type
+	}
+	mime_type, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if mime_type == "" {
+		mime_type = "application/octet-stream"
+	}
+	return name, mime_type
+}
+
+func (s *DriveStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Save ourselves
+	defer func() {
+		if rec := recover(); rec != nil {
+			Log.ErrorF("Recovered: %+v", rec)
+			standin_error(w, fmt.Errorf("%+v", rec))
+		}
+	}()
+
+	Log.DebugF("DriveStandIn: %s %s", r.Method, r.URL)
+	q := r.URL.Query()
+	path := r.URL.Path
+	switch {
+	case path == "/drive/v3/files" && r.Method == http.MethodGet:
+		s.serve_list(w, q)
+	case path == "/drive/v3/files" && r.Method == http.MethodPost:
+		file := &drive.File{}
+		if err := json.NewDecoder(r.Body).Decode(file); err != nil {
+			standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		file, err := s.backend.Create(file, nil)
+		standin_reply(w, file, err)
+	case path == "/drive/v3/files/generateIds" && r.Method == http.MethodGet:
+		count, _ := strconv.Atoi(q.Get("count"))
+		if count <= 0 {
+			count = 10
+		}
+		ids, err := s.backend.GenerateIds(count)
+		if err != nil {
+			standin_error(w, err)
+			return
+		}
+		standin_json(w, http.StatusOK, &drive.GeneratedIds{Ids: ids, Space: "drive", Kind: "drive#generatedIds"})
+	case strings.HasPrefix(path, "/drive/v3/files/") && strings.HasSuffix(path, "/export") && r.Method == http.MethodGet:
+		google_id := strings.TrimSuffix(strings.TrimPrefix(path, "/drive/v3/files/"), "/export")
+		body, err := s.backend.Export(google_id, q.Get("mimeType"))
+		if err != nil {
+			standin_error(w, err)
+			return
+		}
+		defer body.Close()
+		w.Header().Set("Content-Type", q.Get("mimeType"))
+		io.Copy(w, body)
+	case strings.HasPrefix(path, "/drive/v3/files/"):
+		s.serve_file(w, r, strings.TrimPrefix(path, "/drive/v3/files/"))
+	case path == "/upload/drive/v3/files" || strings.HasPrefix(path, "/upload/drive/v3/files/"):
+		s.serve_upload(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "/upload/drive/v3/files"), "/"))
+	case path == "/drive/v3/changes/startPageToken" && r.Method == http.MethodGet:
+		token, err := s.backend.StartPageToken()
+		if err != nil {
+			standin_error(w, err)
+			return
+		}
+		standin_json(w, http.StatusOK, &drive.StartPageToken{StartPageToken: token, Kind: "drive#startPageToken"})
+	case path == "/drive/v3/changes" && r.Method == http.MethodGet:
+		changes, next_token, new_start_token, err := s.backend.Changes(q.Get("pageToken"))
+		if err != nil {
+			standin_error(w, err)
+			return
+		}
+		standin_json(w, http.StatusOK, &drive.ChangeList{Changes: changes, NextPageToken: next_token, NewStartPageToken: new_start_token, Kind: "drive#changeList"})
+	default:
+		standin_error(w, &googleapi.Error{Code: http.StatusNotFound, Message: "Not Found"})
+	}
+}
+
+// files.list. Page tokens are positions in the (sorted) answer.
+func (s *DriveStandIn) serve_list(w http.ResponseWriter, q url.Values) {
+	files, err := s.backend.Query(q.Get("q"))
+	if err != nil {
+		standin_error(w, err)
+		return
+	}
+	// Google Drive may answer with fewer files than asked for, so never send more than STANDIN_LIST_PAGE_SIZE and make clients follow nextPageToken
+	page_size, _ := strconv.Atoi(q.Get("pageSize"))
+	if page_size <= 0 || page_size > STANDIN_LIST_PAGE_SIZE {
+		page_size = STANDIN_LIST_PAGE_SIZE
+	}
+	start := 0
+	if token := q.Get("pageToken"); token != "" {
+		if start, err = strconv.Atoi(token); err != nil || start < 0 || start > len(files) {
+			standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid page token"})
+			return
+		}
+	}
+	ans := &drive.FileList{Kind: "drive#fileList"}
+	if end := start + page_size; end < len(files) {
+		ans.Files = files[start:end]
+		ans.NextPageToken = strconv.Itoa(end)
+	} else {
+		ans.Files = files[start:]
+	}
+	standin_json(w, http.StatusOK, ans)
+}
+
+// files.get (metadata or content), files.update without content and files.delete.
+func (s *DriveStandIn) serve_file(w http.ResponseWriter, r *http.Request, google_id string) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		file, err := s.backend.Get(google_id)
+		if err != nil {
+			standin_error(w, err)
+			return
+		}
+		if q.Get("alt") != "media" {
+			standin_json(w, http.StatusOK, file)
+			return
+		}
+		s.serve_download(w, r, file)
+	case http.MethodPatch:
+		file := &drive.File{}
+		if err := json.NewDecoder(r.Body).Decode(file); err != nil {
+			standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		file, err := s.backend.Update(google_id, file, nil, q.Get("addParents"), q.Get("removeParents"))
+		standin_reply(w, file, err)
+	case http.MethodDelete:
+		if err := s.backend.Delete(google_id, true); err != nil {
+			standin_error(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		standin_error(w, &googleapi.Error{Code: http.StatusMethodNotAllowed, Message: "Method Not Allowed"})
+	}
+}
+
+// alt=media, honouring "Range: bytes=<start>-[<end>]".
+func (s *DriveStandIn) serve_download(w http.ResponseWriter, r *http.Request, file *drive.File) {
+	start, end := int64(0), int64(-1)
+	if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") && !strings.Contains(rng, ",") {
+		parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		var err1, err2 error
+		start, err1 = strconv.ParseInt(parts[0], 10, 64)
+		end = file.Size - 1
+		if len(parts) == 2 && parts[1] != "" {
+			end, err2 = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if err1 != nil || err2 != nil {
+			start, end = 0, -1
+		}
+	}
+	body, partial, err := s.backend.Download(file.Id, start, end)
+	if err != nil {
+		standin_error(w, err)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", file.MimeType)
+	if partial {
+		if end >= file.Size {
+			end = file.Size - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, file.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	}
+	io.Copy(w, body)
+}
+
+// Uploads of new files (POST) and of new content (PATCH), as multipart, media or resumable uploads.
+func (s *DriveStandIn) serve_upload(w http.ResponseWriter, r *http.Request, google_id string) {
+	q := r.URL.Query()
+	if upload_id := q.Get("upload_id"); upload_id != "" {
+		s.serve_upload_chunk(w, r, upload_id)
+		return
+	}
+	if (google_id == "" && r.Method != http.MethodPost) || (google_id != "" && r.Method != http.MethodPatch) {
+		standin_error(w, &googleapi.Error{Code: http.StatusMethodNotAllowed, Message: "Method Not Allowed"})
+		return
+	}
+	up := &standin_upload{
+		google_id:     google_id,
+		file:          &drive.File{},
+		add_parent:    q.Get("addParents"),
+		remove_parent: q.Get("removeParents"),
+	}
+	switch q.Get("uploadType") {
+	case "media":
+		if _, err := up.content.ReadFrom(r.Body); err != nil {
+			standin_error(w, err)
+			return
+		}
+		s.finish_upload(w, up)
+	case "multipart":
+		media_type, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !strings.HasPrefix(media_type, "multipart/") {
+			standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: "Expected a multipart body"})
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		// The metadata comes first and the content second
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(up.file)
+		}
+		if err == nil {
+			if part, err = mr.NextPart(); err == nil {
+				_, err = up.content.ReadFrom(part)
+			}
+		}
+		if err != nil {
+			standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		s.finish_upload(w, up)
+	case "resumable":
+		if err := json.NewDecoder(r.Body).Decode(up.file); err != nil && err != io.EOF {
+			standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()})
+			return
+		}
+		s.mux.Lock()
+		s.next_upload++
+		upload_id := strconv.Itoa(s.next_upload)
+		s.uploads[upload_id] = up
+		s.mux.Unlock()
+		w.Header().Set("Location", "http://"+r.Host+"/upload/drive/v3/files?uploadType=resumable&upload_id="+upload_id)
+		w.WriteHeader(http.StatusOK)
+	default:
+		standin_error(w, &googleapi.Error{Code: http.StatusBadRequest, Message: "Unsupported uploadType " + q.Get("uploadType")})
+	}
+}
+
+// Every chunk comes with "Content-Range: bytes <first>-<last>/<total or *>". Until the last one arrives we answer like Google Drive does when asked not to use 308.
+func (s *DriveStandIn) serve_upload_chunk(w http.ResponseWriter, r *http.Request, upload_id string) {
+	s.mux.Lock()
+	up, found := s.uploads[upload_id]
+	s.mux.Unlock()
+	if !found {
+		standin_error(w, &googleapi.Error{Code: http.StatusNotFound, Message: "Unknown upload " + upload_id})
+		return
+	}
+	if _, err := up.content.ReadFrom(r.Body); err != nil {
+		standin_error(w, err)
+		return
+	}
+	rng := r.Header.Get("Content-Range")
+	total := rng[strings.LastIndex(rng, "/")+1:]
+	if total == "*" || total == "" || total != strconv.Itoa(up.content.Len()) {
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		if up.content.Len() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", up.content.Len()-1))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	s.mux.Lock()
+	delete(s.uploads, upload_id)
+	s.mux.Unlock()
+	s.finish_upload(w, up)
+}
+
+func (s *DriveStandIn) finish_upload(w http.ResponseWriter, up *standin_upload) {
+	media := bytes.NewReader(up.content.Bytes())
+	var file *drive.File
+	var err error
+	if up.google_id == "" {
+		file, err = s.backend.Create(up.file, media)
+	} else {
+		file, err = s.backend.Update(up.google_id, up.file, media, up.add_parent, up.remove_parent)
+	}
+	standin_reply(w, file, err)
+}
+
+// Sends whatever the backend returned.
+func standin_reply(w http.ResponseWriter, file *drive.File, err error) {
+	if err != nil {
+		standin_error(w, err)
+		return
+	}
+	standin_json(w, http.StatusOK, file)
+}
+
+func standin_json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Log.WarningF("DriveStandIn: Failed to send answer: %v", err)
+	}
+}
+
+// Sends err the way Google Drive does, so the client turns it back into a *googleapi.Error.
+func standin_error(w http.ResponseWriter, err error) {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		e = &googleapi.Error{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	standin_json(w, e.Code, map[string]interface{}{
+		"error": map[string]interface{}{"code": e.Code, "message": e.Message},
+	})
+}
+
+// Implements "MegaDrive stand-in DIR": serves DIR as a Drive v3 endpoint until ctrl+c. Mount with -drive-endpoint set to the printed URL to use it.
+func StandInCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage:\n  MegaDrive stand-in DIR\n")
+		return 2
+	}
+	server, err := NewDriveStandInServer(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", args[0], err)
+		return 1
+	}
+	defer server.Close()
+	fmt.Printf("%s/drive/v3/\n", server.URL)
+	sig_chan := make(chan os.Signal, 1)
+	signal.Notify(sig_chan, os.Interrupt)
+	<-sig_chan
+	return 0
+}
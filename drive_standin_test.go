@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const STANDIN_TEST_FILES = STANDIN_LIST_PAGE_SIZE + 50
+
+// Serves a folder with more files than fit on a page through a DriveStandIn and returns the real Drive client backend talking to it.
+func standin_backend(t *testing.T) *DriveServiceBackend {
+	dir := t.TempDir()
+	for i := 0; i < STANDIN_TEST_FILES; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%03d.txt", i)), []byte(fmt.Sprintf("file %d\n", i)), 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "folder"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "folder", "digits.txt"), []byte("0123456789"), 0644)
+	server, err := NewDriveStandInServer(dir)
+	if err != nil {
+		t.Fatalf("NewDriveStandInServer failed: %v", err)
+	}
+	t.Cleanup(server.Close)
+	return NewDriveServiceBackend(GetDriveClient(server.URL + "/drive/v3/"))
+}
+
+// Returns the file called name inside parent_id.
+func standin_find(t *testing.T, b DriveBackend, parent_id, name string) *drive.File {
+	files, err := b.List(parent_id)
+	if err != nil {
+		t.Fatalf("List(%s) failed: %v", parent_id, err)
+	}
+	for _, file := range files {
+		if file.Name == name {
+			return file
+		}
+	}
+	t.Fatalf("%s is not inside %s", name, parent_id)
+	return nil
+}
+
+func standin_download(t *testing.T, b DriveBackend, google_id string, start, end int64) (string, bool) {
+	body, partial, err := b.Download(google_id, start, end)
+	if err != nil {
+		t.Fatalf("Download(%s, %d, %d) failed: %v", google_id, start, end, err)
+	}
+	defer body.Close()
+	byt, _ := ioutil.ReadAll(body)
+	return string(byt), partial
+}
+
+func TestDriveStandInList(t *testing.T) {
+	b := standin_backend(t)
+	files, err := b.List("root")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	// Every page must have been followed
+	if len(files) != STANDIN_TEST_FILES+1 {
+		t.Fatalf("Got %d files instead of %d", len(files), STANDIN_TEST_FILES+1)
+	}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if seen[file.Name] {
+			t.Errorf("%s was listed twice", file.Name)
+		}
+		seen[file.Name] = true
+	}
+	if !seen["folder"] || !seen[fmt.Sprintf("file%03d.txt", STANDIN_TEST_FILES-1)] {
+		t.Errorf("The folder or the last file are missing")
+	}
+}
+
+func TestDriveStandInDownload(t *testing.T) {
+	b := standin_backend(t)
+	folder := standin_find(t, b, "root", "folder")
+	digits := standin_find(t, b, folder.Id, "digits.txt")
+	if digits.Size != 10 || digits.Md5Checksum == "" {
+		t.Errorf("Got %+v for digits.txt", digits)
+	}
+	if content, partial := standin_download(t, b, digits.Id, 3, 5); content != "345" || !partial {
+		t.Errorf("Downloading bytes 3-5 returned %q (partial: %v)", content, partial)
+	}
+	if content, partial := standin_download(t, b, digits.Id, 0, -1); content != "0123456789" || partial {
+		t.Errorf("Downloading everything returned %q (partial: %v)", content, partial)
+	}
+}
+
+func TestDriveStandInWrite(t *testing.T) {
+	b := standin_backend(t)
+	folder := standin_find(t, b, "root", "folder")
+	ids, err := b.GenerateIds(1)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("GenerateIds returned %v, %v", ids, err)
+	}
+
+	created, err := b.Create(&drive.File{Id: ids[0], Name: "new.txt", MimeType: "text/plain", Parents: []string{"root"}}, strings.NewReader("new"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if created.Id != ids[0] || created.Name != "new.txt" || created.Size != 3 {
+		t.Errorf("Create returned %+v", created)
+	}
+
+	updated, err := b.Update(created.Id, &drive.File{Name: "renamed.txt"}, strings.NewReader("newer"), folder.Id, "root")
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if updated.Name != "renamed.txt" || updated.Size != 5 || updated.Md5Checksum == created.Md5Checksum || len(updated.Parents) != 1 || updated.Parents[0] != folder.Id {
+		t.Errorf("Update returned %+v", updated)
+	}
+	if content, _ := standin_download(t, b, created.Id, 0, -1); content != "newer" {
+		t.Errorf("Got %q after the update", content)
+	}
+	standin_find(t, b, folder.Id, "renamed.txt")
+
+	if err := b.Delete(created.Id, true); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := b.Get(created.Id); !DriveIsNotFound(err) {
+		t.Errorf("Get gave %v instead of 404 after deleting", err)
+	}
+	// Trashed files are no longer listed
+	first := standin_find(t, b, "root", "file000.txt")
+	if err := b.Delete(first.Id, false); err != nil {
+		t.Fatalf("Moving to the trash failed: %v", err)
+	}
+	if files, err := b.List("root"); err != nil || len(files) != STANDIN_TEST_FILES {
+		t.Errorf("Got %d files (%v) after trashing one", len(files), err)
+	}
+}
+
+func TestDriveStandInChanges(t *testing.T) {
+	b := standin_backend(t)
+	token, err := b.StartPageToken()
+	if err != nil {
+		t.Fatalf("StartPageToken failed: %v", err)
+	}
+	created, err := b.Create(&drive.File{Name: "new.txt", MimeType: "text/plain", Parents: []string{"root"}}, strings.NewReader("new"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := b.Delete(created.Id, true); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	changes, next_token, new_start_token, err := b.Changes(token)
+	if err != nil || next_token != "" || new_start_token == "" {
+		t.Fatalf("Changes(%s) returned %q, %q, %v", token, next_token, new_start_token, err)
+	}
+	if len(changes) != 2 || changes[0].FileId != created.Id || changes[0].File == nil || changes[0].File.Name != "new.txt" || !changes[1].Removed {
+		t.Errorf("Got %+v instead of the creation and removal of %s", changes, created.Id)
+	}
+	if changes, _, _, err := b.Changes(new_start_token); err != nil || len(changes) != 0 {
+		t.Errorf("Got %d changes (%v) when nothing changed", len(changes), err)
+	}
+}
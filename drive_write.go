@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"google.golang.org/api/drive/v3"
+)
+
+// How many file ids we keep around so files and folders can be created while offline.
+const WRITE_ID_POOL_SIZE = 100
+
+// Most functions in this file talk to Google Drive right away and are only meant to be called by JournalReplay. They return plain errors so JournalConsumer can decide whether to try again later.
+
+// Takes a file id from the pool, asking Google Drive for more if it is empty. This way new files can be staged on CacheDir+google_id and be found by Lookup before their content is uploaded.
+func DriveGenerateId(backend DriveBackend) (string, fuse.Status) {
+	CLock("IdPool:!mux")
+	defer CUnlock("IdPool:!mux")
+
+	pool := make([]string, 0)
+	CGet("IdPool", &pool)
+	if len(pool) == 0 {
+		var err error
+		pool, err = DriveGenerateIds(backend, WRITE_ID_POOL_SIZE)
+		if err != nil {
+			Log.ErrorF("Unable to generate a new file id: %v", err)
+			return "", fuse.EIO
+		}
+	}
+	CSet("IdPool", pool[1:])
+	return pool[0], fuse.OK
+}
+
+// Refills the id pool if it is less than half full.
+func DriveFillIdPool(backend DriveBackend) {
+	CLock("IdPool:!mux")
+	defer CUnlock("IdPool:!mux")
+
+	pool := make([]string, 0)
+	CGet("IdPool", &pool)
+	if len(pool) >= WRITE_ID_POOL_SIZE/2 {
+		return
+	}
+	ids, err := DriveGenerateIds(backend, WRITE_ID_POOL_SIZE-len(pool))
+	if err != nil {
+		Log.WarningF("Unable to refill the id pool: %v", err)
+		return
+	}
+	CSet("IdPool", append(pool, ids...))
+}
+
+func DriveGenerateIds(backend DriveBackend, count int) ([]string, error) {
+	ids, err := backend.GenerateIds(count)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no ids were returned")
+	}
+	return ids, nil
+}
+
+// Uploads the staged copy of google_id (CacheDir+google_id) as a new file inside parent_id.
+func DriveCreate(backend DriveBackend, google_id, parent_id, name, mime_type string) (ret_err error) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_err = &RecoveredError{r}
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("DriveCreate", &_start)
+	Log.InfoF("DriveCreate: Uploading %s (%s) to the Internet", google_id, name)
+
+	// Open staged file
+	r, err := os.Open(CacheDir + google_id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Upload it
+	file := &drive.File{
+		Id:       google_id,
+		Name:     name,
+		MimeType: mime_type,
+		Parents:  []string{parent_id},
+	}
+	ans, err := backend.Create(file, r)
+	if err != nil {
+		return err
+	}
+	Log.InfoF("DriveCreate: SAVED %s (%s) on the Internet", google_id, name)
+
+	// Set cache
+	DriveGetBasicsPutFile(ans)
+	DriveWriteMarkCached(ans)
+	return nil
+}
+
+// Creates a folder named name inside parent_id using google_id as its id.
+func DriveMkdir(backend DriveBackend, google_id, parent_id, name string) (ret_err error) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_err = &RecoveredError{r}
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("DriveMkdir", &_start)
+	Log.InfoF("DriveMkdir: Creating %s (%s) in %s on the Internet", google_id, name, parent_id)
+
+	file := &drive.File{
+		Id:       google_id,
+		Name:     name,
+		MimeType: MimeTypeGoogleFolder,
+		Parents:  []string{parent_id},
+	}
+	ans, err := backend.Create(file, nil)
+	if err != nil {
+		return err
+	}
+	Log.InfoF("DriveMkdir: CREATED %s (%s) on the Internet", ans.Id, name)
+
+	// Set cache
+	DriveGetBasicsPutFile(ans)
+	return nil
+}
+
+// Uploads the local copy of google_id (CacheDir+google_id) as a new revision of an existing file.
+func DriveUpdate(backend DriveBackend, google_id string) (ret_err error) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_err = &RecoveredError{r}
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("DriveUpdate", &_start)
+	Log.InfoF("DriveUpdate: Uploading %s to the Internet", google_id)
+
+	// Do not overwrite changes someone else made in the meantime
+	remote, conflict, err := DriveCheckConflict(backend, google_id)
+	if err != nil {
+		return err
+	}
+	if conflict {
+		return DriveSaveConflict(backend, google_id, remote)
+	}
+
+	// Open local copy
+	r, err := os.Open(CacheDir + google_id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Upload it
+	ans, err := backend.Update(google_id, &drive.File{}, r, "", "")
+	if err != nil {
+		return err
+	}
+	Log.InfoF("DriveUpdate: SAVED %s (%s) on the Internet", google_id, ans.Name)
+
+	// Set cache
+	DriveGetBasicsPutFile(ans)
+	DriveWriteMarkCached(ans)
+	return nil
+}
+
+// Renames google_id to name and moves it from old_parent to new_parent.
+func DriveRename(backend DriveBackend, google_id, name, old_parent, new_parent string) (ret_err error) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_err = &RecoveredError{r}
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("DriveRename", &_start)
+	Log.InfoF("DriveRename: Moving %s to %s in %s on the Internet", google_id, name, new_parent)
+
+	add_parent, remove_parent := "", ""
+	if old_parent != new_parent {
+		add_parent, remove_parent = new_parent, old_parent
+	}
+	ans, err := backend.Update(google_id, &drive.File{Name: name}, nil, add_parent, remove_parent)
+	if err != nil {
+		return err
+	}
+	Log.InfoF("DriveRename: MOVED %s (%s) on the Internet", google_id, ans.Name)
+
+	// Set cache
+	DriveGetBasicsPutFile(ans)
+	return nil
+}
+
+// Moves google_id to the trash or, if DeletePermanently is set, deletes it for good.
+func DriveRemove(backend DriveBackend, google_id string) (ret_err error) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_err = &RecoveredError{r}
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("DriveRemove", &_start)
+
+	if DeletePermanently {
+		Log.InfoF("DriveRemove: Deleting %s on the Internet", google_id)
+	} else {
+		Log.InfoF("DriveRemove: Trashing %s on the Internet", google_id)
+	}
+	// Already gone is just as good
+	if err := backend.Delete(google_id, DeletePermanently); err != nil && !DriveIsNotFound(err) {
+		return err
+	}
+	Log.InfoF("DriveRemove: REMOVED %s on the Internet", google_id)
+	DriveForget(google_id)
+	return nil
+}
+
+// Drops everything we know about google_id: its BasicsRecord, OpenDir, Read and Block entries and its cached content.
+func DriveForget(google_id string) {
+	BasicsForget(google_id)
+	CDelPrefix("OpenDir:" + google_id + ":")
+	CDelPrefix("Read:" + google_id + ":")
+	CDelPrefix("Block:" + google_id + ":")
+	CDel("OpenDir:" + google_id)
+	if err := os.Remove(CacheDir + google_id); err != nil && !os.IsNotExist(err) {
+		Log.WarningF("Failed to remove cache file for %s: %v", google_id, err)
+	}
+}
+
+// Tells DriveReadConsumer that the local copy of file is the same as the uploaded one, so it does not need to be downloaded again.
+func DriveWriteMarkCached(file *drive.File) {
+	mtime, err := time.Parse(time.RFC3339, file.ModifiedTime)
+	if err != nil {
+		Log.WarningF("Failed to parse mtime for %s: %v", file.Id, err)
+		return
+	}
+	if err := os.Chtimes(CacheDir+file.Id, mtime, mtime); err != nil {
+		Log.WarningF("Failed to set mtime on cache file for %s: %v", file.Id, err)
+		return
+	}
+	CSet("Read:"+file.Id+":!Mtime", mtime.Unix())
+	CSet("Read:"+file.Id+":!MD5", file.Md5Checksum)
+	CSet("Read:"+file.Id+":!Revision", file.HeadRevisionId)
+	CSet("Read:"+file.Id+":!ret", fuse.OK)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// MDFile is an open handle to a copy of a file staged on CacheDir+GoogleId. Reads and writes go to the local copy and, if anything was written, it is queued for upload on Flush/Release.
+type MDFile struct {
+	nodefs.File
+	node      *MDNode
+	parent_id string
+	dirty     bool
+	created   bool
+	mux       sync.Mutex
+}
+
+// Wraps the staged file f. created must be false when the file does not exist on Google Drive yet. parent_id is only used in that case.
+func NewMDFile(node *MDNode, parent_id string, f *os.File, created bool) *MDFile {
+	CacheOpen(node.GoogleId)
+	return &MDFile{
+		File:      nodefs.NewLoopbackFile(f),
+		node:      node,
+		parent_id: parent_id,
+		created:   created,
+	}
+}
+
+func (f *MDFile) String() string {
+	return "MDFile(" + f.node.GoogleId + ")"
+}
+
+func (f *MDFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *MDFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mux.Lock()
+	f.dirty = true
+	f.mux.Unlock()
+	return f.File.Write(data, off)
+}
+
+func (f *MDFile) Truncate(size uint64) fuse.Status {
+	f.mux.Lock()
+	f.dirty = true
+	f.mux.Unlock()
+	code := f.File.Truncate(size)
+	if code == fuse.OK {
+		BasicsUpdateLocal(f.node.GoogleId)
+	}
+	return code
+}
+
+func (f *MDFile) Flush() fuse.Status {
+	Log.DebugF("MDFile.Flush (%s)", f.node.GoogleId)
+	if code := f.File.Flush(); code != fuse.OK {
+		return code
+	}
+	code := f.upload()
+	BasicsUpdateLocal(f.node.GoogleId)
+	return code
+}
+
+func (f *MDFile) Release() {
+	Log.DebugF("MDFile.Release (%s)", f.node.GoogleId)
+	if code := f.upload(); code != fuse.OK {
+		Log.ErrorF("Failed to upload %s on release: %v", f.node.GoogleId, code)
+	}
+	f.File.Release()
+	BasicsUpdateLocal(f.node.GoogleId)
+	CacheClose(f.node.GoogleId)
+}
+
+// Queues the local copy to be sent to Google Drive if it was changed since the last upload.
+func (f *MDFile) upload() fuse.Status {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if !f.dirty {
+		return fuse.OK
+	}
+	entry := JournalEntry{Op: JournalOpUpdate, GoogleId: f.node.GoogleId}
+	if !f.created {
+		entry.Op = JournalOpCreate
+		entry.Name = f.node.name()
+		entry.MimeType = f.node.mime_type()
+		entry.NewParent = f.parent_id
+	}
+	JournalAppend(entry)
+	f.dirty = false
+	f.created = true
+	return fuse.OK
+}
+
+// MDReadFile is a read-only handle. It keeps its own descriptor of the cached copy, so a newer version that is renamed into place is only seen after opening the file again. Files that are not completely cached yet are loaded (and, if replaced meanwhile, reopened) as they are read.
+type MDReadFile struct {
+	nodefs.File
+	node     *MDNode
+	f        *os.File
+	complete bool
+	mux      sync.Mutex
+}
+
+// Opens the cached copy right away if it is complete and fresh, otherwise on the first Read.
+func NewMDReadFile(node *MDNode) *MDReadFile {
+	rf := &MDReadFile{File: nodefs.NewDefaultFile(), node: node}
+	if !DriveReadNeedsDownload(node.GoogleId) && !CFound("Block:"+node.GoogleId+":!bitmap") {
+		rf.open(CacheDir+node.GoogleId, true)
+	}
+	return rf
+}
+
+func (f *MDReadFile) String() string {
+	return "MDReadFile(" + f.node.GoogleId + ")"
+}
+
+func (f *MDReadFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+// Makes f read from path unless it already does.
+func (f *MDReadFile) open(path string, complete bool) fuse.Status {
+	if f.f != nil {
+		old, err1 := f.f.Stat()
+		cur, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(old, cur) {
+			f.complete = complete
+			return fuse.OK
+		}
+		// The copy we had was replaced before it was complete, so it is of no use anymore
+		f.File.Release()
+		CacheClose(f.node.GoogleId)
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		Log.ErrorF("Unable to Read %s: %v", f.node.GoogleId, err)
+		f.f = nil
+		f.File = nodefs.NewDefaultFile()
+		return fuse.EIO
+	}
+	CacheOpen(f.node.GoogleId)
+	f.f = r
+	f.File = nodefs.NewLoopbackFile(r)
+	f.complete = complete
+	return fuse.OK
+}
+
+// Ensures the bytes [off, off+size) are on the file f reads from.
+func (f *MDReadFile) load(off int64, size int) fuse.Status {
+	google_id := f.node.GoogleId
+	path := CacheDir + google_id
+	var sts fuse.Status
+	// Exported files can not be downloaded in parts
+	if _, export := DriveExportMimeType(f.node.mime_type()); export || !ReadBlocks() {
+		path, sts = DriveReadStream(google_id, off, size)
+	} else {
+		sts = DriveReadRange(f.node.backend, google_id, off, size)
+	}
+	if sts != fuse.OK {
+		Log.ErrorF("Unable to Read %s: %v", google_id, sts)
+		return sts
+	}
+	complete := path == CacheDir+google_id && !CFound("Block:"+google_id+":!bitmap")
+	sts = f.open(path, complete)
+	if sts != fuse.OK && path != CacheDir+google_id {
+		// The download finished in the meantime
+		sts = f.open(CacheDir+google_id, !CFound("Block:"+google_id+":!bitmap"))
+	}
+	return sts
+}
+
+func (f *MDReadFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !f.complete {
+		if sts := f.load(off, len(dest)); sts != fuse.OK {
+			return nil, sts
+		}
+	}
+	CacheTouch(f.node.GoogleId)
+	return f.File.Read(dest, off)
+}
+
+func (f *MDReadFile) Release() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	Log.DebugF("MDReadFile.Release (%s)", f.node.GoogleId)
+	if f.f != nil {
+		f.File.Release()
+		f.f = nil
+		CacheClose(f.node.GoogleId)
+	}
+}
+
+// The node knows better than the cached copy (how big an exported file is, for one).
+func (f *MDReadFile) GetAttr(out *fuse.Attr) fuse.Status {
+	return fuse.ENOSYS
+}
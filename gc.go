@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const GC_INTERVAL = 1 * time.Hour
+
+// Setting this extended attribute on any file or folder runs GcCollect right away.
+const GC_XATTR = "user.megadrive.gc"
+
+// Files on CacheDir are named after their ids. Anything else (bolt.db, google.json, ...) is never touched.
+var gc_blob_name = regexp.MustCompile(`^[A-Za-z0-9_-]{10,}$`)
+
+// GcConsumer throws away whatever is cached about files that can no longer be reached from "root" (or from a pinned file) through the cached listings. Files removed on Google Drive are already forgotten by ChangesApply, but their children and stale Lookup entries are only cleaned up here.
+var ChGc = make(chan bool, 1)
+
+// Asks GcConsumer to run soon. Nothing happens if it was already asked to.
+func GcRequest() {
+	select {
+	case ChGc <- true:
+	default:
+	}
+}
+
+func GcConsumer() {
+	Log.Notice("GcConsumer: Started")
+	for !Unmounting() {
+		select {
+		case <-ChGc:
+		case <-time.After(GC_INTERVAL):
+		}
+		GcCollect()
+	}
+}
+
+// Returns every id that can be reached from root, pinned files and files the kernel knows about.
+func GcReachable() map[string]bool {
+	reachable := make(map[string]bool)
+	queue := append([]string{"root"}, PinList()...)
+	MapIdNodesMux.Lock()
+	for google_id := range MapIdNodes {
+		queue = append(queue, google_id)
+	}
+	MapIdNodesMux.Unlock()
+
+	for len(queue) > 0 {
+		google_id := queue[0]
+		queue = queue[1:]
+		if reachable[google_id] {
+			continue
+		}
+		reachable[google_id] = true
+		var dirs []fuse.DirEntry
+		CGet("OpenDir:"+google_id, &dirs)
+		for _, entry := range dirs {
+			if child_id := CGet_str("Lookup:" + entry.Name + ":in:" + google_id + ":id"); child_id != "" {
+				queue = append(queue, child_id)
+			}
+		}
+	}
+	return reachable
+}
+
+// Tells whether whatever we have about google_id must be kept even if it can not be reached.
+func gc_keep(google_id string, reachable map[string]bool) bool {
+	return reachable[google_id] || JournalPending(google_id) || PinIsKept(google_id) || CacheIsOpen(google_id)
+}
+
+// Returns the id a key is about, or "" if the key is not about a single file.
+func gc_key_id(key string) string {
+	for _, prefix := range []string{"Basics:", "Read:", "Block:", "OpenDir:", "Conflict:"} {
+		if strings.HasPrefix(key, prefix) {
+			return strings.SplitN(strings.TrimPrefix(key, prefix), ":", 2)[0]
+		}
+	}
+	return ""
+}
+
+func GcCollect() {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+		}
+	}()
+
+	_start := time.Now()
+	defer PrintCallDuration("GcCollect", &_start)
+
+	reachable := GcReachable()
+	listings := make(map[string]map[string]bool)
+	forgotten := make(map[string]bool)
+	del := make([]string, 0)
+	for _, key := range CKeysPrefix("") {
+		// Lookup:<name>:in:<parent>:<field>
+		if strings.HasPrefix(key, "Lookup:") {
+			i := strings.LastIndex(key, ":in:")
+			if i < 0 {
+				continue
+			}
+			name := strings.TrimPrefix(key[:i], "Lookup:")
+			parent_id := strings.SplitN(key[i+len(":in:"):], ":", 2)[0]
+			if !gc_keep(parent_id, reachable) {
+				del = append(del, key)
+				continue
+			}
+			// Names that are no longer on a (cached) listing. Listings being loaded right now are left alone as their Lookup entries are saved first.
+			if _, ok := listings[parent_id]; !ok {
+				listings[parent_id] = nil
+				if CFound("OpenDir:"+parent_id) && CGetDef_int64("OpenDir:"+parent_id+":!WorkTimeout", 0) <= time.Now().Unix() {
+					var dirs []fuse.DirEntry
+					CGet("OpenDir:"+parent_id, &dirs)
+					listings[parent_id] = make(map[string]bool)
+					for _, entry := range dirs {
+						listings[parent_id][entry.Name] = true
+					}
+				}
+			}
+			if listings[parent_id] != nil && !listings[parent_id][name] {
+				del = append(del, key)
+			}
+			continue
+		}
+		if google_id := gc_key_id(key); google_id != "" && !gc_keep(google_id, reachable) {
+			del = append(del, key)
+			forgotten[google_id] = true
+		}
+	}
+	CDel(del...)
+
+	// Files on CacheDir
+	removed := 0
+	infos, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		Log.ErrorF("Unable to list %s: %v", CacheDir, err)
+		return
+	}
+	for _, info := range infos {
+		google_id := info.Name()
+		if !info.Mode().IsRegular() || !gc_blob_name.MatchString(google_id) || gc_keep(google_id, reachable) {
+			continue
+		}
+		if err := os.Remove(CacheDir + google_id); err != nil {
+			Log.WarningF("Failed to remove cache file for %s: %v", google_id, err)
+			continue
+		}
+		removed++
+	}
+	Log.InfoF("GcCollect: Forgot %d files (%d keys) and removed %d cache files", len(forgotten), len(del), removed)
+}
+
+// Implements "MegaDrive gc PATH". It works on an already mounted MegaDrive by setting the gc extended attribute.
+func GcCommand(paths []string) int {
+	if len(paths) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage:\n  MegaDrive gc MOUNTPOINT\n")
+		return 2
+	}
+	if err := syscall.Setxattr(paths[0], GC_XATTR, []byte("1"), 0); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to collect garbage on %s: %v\n", paths[0], err)
+		return 1
+	}
+	return 0
+}
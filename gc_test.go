@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Puts a downloaded copy of google_id on CacheDir along with its basics.
+func gc_put(t *testing.T, google_id string) {
+	if err := ioutil.WriteFile(CacheDir+google_id, []byte(google_id), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.Name = google_id })
+	CSet("Read:"+google_id+":!ret", fuse.OK)
+}
+
+// Tells whether anything about google_id is still around.
+func gc_known(google_id string) bool {
+	_, err := os.Stat(CacheDir + google_id)
+	_, found := BasicsGet(google_id)
+	return err == nil || found || CFound("Read:"+google_id+":!ret")
+}
+
+func TestGcCollect(t *testing.T) {
+	b := fake_drive_env(t)
+	test_nodes_reset()
+	folder := b.Put("root", "folder", MimeTypeGoogleFolder, nil)
+	inside := b.Put(folder.Id, "inside.txt", "text/plain", nil)
+	top := b.Put("root", "top.txt", "text/plain", nil)
+	DriveOpenDirConsumerCore(b, "root")
+	DriveOpenDirConsumerCore(b, folder.Id)
+	orphans := []string{"orphan0000000001", "pinned0000000001", "pending000000001", "open000000000001", "gone000000000001"}
+	for _, google_id := range append([]string{inside.Id, top.Id}, orphans...) {
+		gc_put(t, google_id)
+	}
+	// Whatever is pinned, waiting to be uploaded or open is kept even if no listing has it
+	PinSet("pinned0000000001", true)
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "pending000000001"})
+	CacheOpen("open000000000001")
+	defer CacheClose("open000000000001")
+	// A folder no listing reaches takes what is inside it along
+	CSet("OpenDir:gone000000000001", []fuse.DirEntry{{Name: "child.txt"}})
+	CSet("Lookup:child.txt:in:gone000000000001:id", "child00000000001")
+	gc_put(t, "child00000000001")
+	// Names that are no longer on their listing
+	CSet("Lookup:stale.txt:in:root:id", "orphan0000000001")
+	// Files that are not named after an id
+	ioutil.WriteFile(CacheDir+"bolt.db", []byte("db"), 0644)
+
+	GcCollect()
+	for _, google_id := range []string{inside.Id, top.Id, "pinned0000000001", "pending000000001", "open000000000001"} {
+		if !gc_known(google_id) {
+			t.Errorf("%s was collected although it is reachable", google_id)
+		}
+	}
+	for _, google_id := range []string{"orphan0000000001", "gone000000000001", "child00000000001"} {
+		if gc_known(google_id) {
+			t.Errorf("%s was not collected", google_id)
+		}
+	}
+	if CFound("Lookup:stale.txt:in:root:id") || CFound("Lookup:child.txt:in:gone000000000001:id") {
+		t.Errorf("Stale names were not collected")
+	}
+	if !CFound("Lookup:inside.txt:in:"+folder.Id+":id") || !CFound("OpenDir:"+folder.Id) {
+		t.Errorf("The listing of folder was collected")
+	}
+	if _, err := os.Stat(CacheDir + "bolt.db"); err != nil {
+		t.Errorf("bolt.db was removed: %v", err)
+	}
+}
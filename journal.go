@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const JOURNAL_RETRY_MIN = 5 * time.Second
+const JOURNAL_RETRY_MAX = 5 * time.Minute
+
+// Mutations are not sent to Google Drive right away. Instead, they are saved on JournalBucket and JournalConsumer replays them in order, retrying for as long as Google Drive can not be reached. Meanwhile, the cache already shows the new state and the "Journal:<id>:!pending" counter stops DriveGetBasics, DriveOpenDir and DriveRead from overwriting it with older data from the Internet.
+var JournalBucket = []byte("journal")
+
+// Entries Google Drive refused for good are moved here with the error. The "Journal:<id>:!pending" counter of the file itself is kept, so the local copy is neither overwritten nor collected and can still be saved by hand, but its folders are loaded from Google Drive again.
+var JournalDeadBucket = []byte("journal-dead")
+var ChJournal = make(chan bool, 1)
+
+// Key of the entry JournalConsumer is sending right now. Nothing is merged into it as the file may have been read already.
+var JournalInFlight []byte
+var JournalInFlightMux = new(sync.Mutex)
+
+const JournalOpCreate = "create"
+const JournalOpUpdate = "update"
+const JournalOpMkdir = "mkdir"
+const JournalOpRename = "rename"
+const JournalOpRemove = "remove"
+
+type JournalEntry struct {
+	Op        string
+	GoogleId  string
+	Name      string `json:",omitempty"`
+	MimeType  string `json:",omitempty"`
+	OldParent string `json:",omitempty"`
+	NewParent string `json:",omitempty"`
+	Time      int64
+	Error     string `json:",omitempty"` // Only on JournalDeadBucket
+}
+
+// Returns every id whose cached data is changed by this entry.
+func (e JournalEntry) Ids() []string {
+	ids := []string{e.GoogleId}
+	if e.OldParent != "" {
+		ids = append(ids, e.OldParent)
+	}
+	if e.NewParent != "" && e.NewParent != e.OldParent {
+		ids = append(ids, e.NewParent)
+	}
+	return ids
+}
+
+func journal_key(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// Saves entry on the journal and wakes up JournalConsumer. Uploads of a file that is already waiting to be uploaded (but not being uploaded) are merged as the newest content is always sent. Removing a file that was never sent drops everything about it instead.
+func JournalAppend(entry JournalEntry) {
+	entry.Time = time.Now().Unix()
+	JournalInFlightMux.Lock()
+	defer JournalInFlightMux.Unlock()
+	dropped := make([]JournalEntry, 0)
+	err := Store.Update(func(tx StoreTx) error {
+		if entry.Op == JournalOpRemove {
+			var err error
+			if dropped, err = journal_drop_unsent(tx, entry.GoogleId); err != nil {
+				return err
+			}
+			if len(dropped) > 0 {
+				return nil
+			}
+		}
+		if entry.Op == JournalOpUpdate {
+			merged := false
+			err := tx.ForEach(JournalBucket, nil, func(k, v []byte) error {
+				other := JournalEntry{}
+				if err := json.Unmarshal(v, &other); err != nil {
+					return err
+				}
+				if bytes.Equal(k, JournalInFlight) {
+					return nil
+				}
+				if other.GoogleId == entry.GoogleId && (other.Op == JournalOpCreate || other.Op == JournalOpUpdate) {
+					merged = true
+					return ErrStoreStop
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if merged {
+				Log.DebugF("JournalAppend: %s is already waiting to be uploaded", entry.GoogleId)
+				return nil
+			}
+		}
+
+		seq, err := tx.NextSequence(JournalBucket)
+		if err != nil {
+			return err
+		}
+		byt, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(JournalBucket, journal_key(seq), byt); err != nil {
+			return err
+		}
+		return journal_add_pending(tx, entry, 1)
+	})
+	if err != nil {
+		Log.PanicF("Failed to save %s of %s onto the journal: %v", entry.Op, entry.GoogleId, err)
+	}
+	if len(dropped) > 0 {
+		Log.InfoF("JournalAppend: %s was never sent, dropped %d entries instead", entry.GoogleId, len(dropped))
+		for _, other := range dropped {
+			journal_apply_skipped(other.Ids())
+		}
+		return
+	}
+	Log.InfoF("JournalAppend: %s of %s (%s) queued", entry.Op, entry.GoogleId, entry.Name)
+
+	// Wake up JournalConsumer
+	select {
+	case ChJournal <- true:
+	default:
+	}
+}
+
+// Deletes every entry of google_id if its creation was not sent yet (nor is being sent), so a file that is removed right away never reaches Google Drive. Folders other entries still need are left alone. Returns the entries deleted.
+func journal_drop_unsent(tx StoreTx, google_id string) ([]JournalEntry, error) {
+	keys := make([][]byte, 0)
+	entries := make([]JournalEntry, 0)
+	created, needed := false, false
+	err := tx.ForEach(JournalBucket, nil, func(k, v []byte) error {
+		other := JournalEntry{}
+		if err := json.Unmarshal(v, &other); err != nil {
+			return err
+		}
+		if other.GoogleId != google_id {
+			needed = needed || other.OldParent == google_id || other.NewParent == google_id
+			return nil
+		}
+		if bytes.Equal(k, JournalInFlight) {
+			return ErrStoreStop
+		}
+		if other.Op == JournalOpCreate || other.Op == JournalOpMkdir {
+			created = true
+		}
+		keys = append(keys, append([]byte{}, k...))
+		entries = append(entries, other)
+		return nil
+	})
+	if err != nil && err != ErrStoreStop {
+		return nil, err
+	}
+	if err == ErrStoreStop || !created || needed {
+		return nil, nil
+	}
+	for i, key := range keys {
+		if err := tx.Delete(JournalBucket, key); err != nil {
+			return nil, err
+		}
+		if err := journal_add_pending(tx, entries[i], -1); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func journal_add_pending(tx StoreTx, entry JournalEntry, delta int64) error {
+	return journal_add_pending_ids(tx, entry.Ids(), delta)
+}
+
+func journal_add_pending_ids(tx StoreTx, ids []string, delta int64) error {
+	for _, id := range ids {
+		key := []byte("Journal:" + id + ":!pending")
+		count, _ := strconv.ParseInt(string(tx.Get(StdBucket, key)), 10, 64)
+		count += delta
+		var err error
+		if count > 0 {
+			err = tx.Put(StdBucket, key, []byte(strconv.FormatInt(count, 10)))
+		} else {
+			err = tx.Delete(StdBucket, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tells whether google_id has changes that were not sent to Google Drive yet.
+func JournalPending(google_id string) bool {
+	return CGetDef_int64("Journal:"+google_id+":!pending", 0) > 0
+}
+
+// Returns the oldest entry on the journal.
+func JournalPeek() (key []byte, entry JournalEntry, found bool) {
+	err := Store.View(func(tx StoreTx) error {
+		return tx.ForEach(JournalBucket, nil, func(k, v []byte) error {
+			key = make([]byte, len(k))
+			copy(key, k)
+			found = true
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			return ErrStoreStop
+		})
+	})
+	if err != nil {
+		Log.PanicF("Failed to read the journal: %v", err)
+	}
+	return
+}
+
+// Returns the oldest entry on the journal and marks it as in flight.
+func journal_start() (key []byte, entry JournalEntry, found bool) {
+	JournalInFlightMux.Lock()
+	defer JournalInFlightMux.Unlock()
+	key, entry, found = JournalPeek()
+	JournalInFlight = key
+	return
+}
+
+// Lets JournalAppend merge into the entry again, say, while waiting to retry it.
+func journal_stop() {
+	JournalInFlightMux.Lock()
+	defer JournalInFlightMux.Unlock()
+	JournalInFlight = nil
+}
+
+// Removes an entry from the journal once it was replayed (or given up on).
+func JournalDone(key []byte, entry JournalEntry) {
+	defer journal_stop()
+	err := Store.Update(func(tx StoreTx) error {
+		if err := tx.Delete(JournalBucket, key); err != nil {
+			return err
+		}
+		return journal_add_pending(tx, entry, -1)
+	})
+	if err != nil {
+		Log.PanicF("Failed to remove %s of %s from the journal: %v", entry.Op, entry.GoogleId, err)
+	}
+	journal_apply_skipped(entry.Ids())
+}
+
+// Applies the remote changes that had to wait for ids that have nothing left to upload.
+func journal_apply_skipped(ids []string) {
+	for _, id := range ids {
+		if !JournalPending(id) {
+			ChangesApplySkipped(id)
+		}
+	}
+}
+
+// Moves an entry that can not be replayed to JournalDeadBucket.
+func JournalGiveUp(key []byte, entry JournalEntry, reason error) {
+	defer journal_stop()
+	entry.Error = reason.Error()
+	err := Store.Update(func(tx StoreTx) error {
+		byt, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(JournalDeadBucket, key, byt); err != nil {
+			return err
+		}
+		if err := tx.Delete(JournalBucket, key); err != nil {
+			return err
+		}
+		// Otherwise the folders would never be loaded again
+		return journal_add_pending_ids(tx, entry.Ids()[1:], -1)
+	})
+	if err != nil {
+		Log.PanicF("Failed to move %s of %s out of the journal: %v", entry.Op, entry.GoogleId, err)
+	}
+	journal_apply_skipped(entry.Ids()[1:])
+}
+
+// Sends a single entry to Google Drive.
+func JournalReplay(backend DriveBackend, entry JournalEntry) error {
+	switch entry.Op {
+	case JournalOpCreate:
+		return DriveCreate(backend, entry.GoogleId, entry.NewParent, entry.Name, entry.MimeType)
+	case JournalOpUpdate:
+		return DriveUpdate(backend, entry.GoogleId)
+	case JournalOpMkdir:
+		return DriveMkdir(backend, entry.GoogleId, entry.NewParent, entry.Name)
+	case JournalOpRename:
+		return DriveRename(backend, entry.GoogleId, entry.Name, entry.OldParent, entry.NewParent)
+	case JournalOpRemove:
+		return DriveRemove(backend, entry.GoogleId)
+	}
+	Log.ErrorF("JournalReplay: Unknown operation %s for %s", entry.Op, entry.GoogleId)
+	return nil
+}
+
+// Tells whether trying again later may work. Expired tokens, rate limits and errors on Google's side go away by themselves; other errors Google Drive blames on our request, missing local files and panics will not.
+func JournalRetryable(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		switch e.Code {
+		case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		case http.StatusForbidden:
+			for _, item := range e.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return true
+				}
+			}
+			return false
+		}
+		return e.Code >= 500
+	case *os.PathError, *RecoveredError:
+		return false
+	}
+	// Most likely the network
+	return true
+}
+
+func JournalConsumer(backend DriveBackend) {
+	Log.Notice("JournalConsumer: Started")
+	wait := JOURNAL_RETRY_MIN
+	for !Unmounting() {
+		key, entry, found := journal_start()
+		if !found {
+			// Use the quiet time to get ids for files created offline
+			DriveFillIdPool(backend)
+			select {
+			case <-ChJournal:
+			case <-time.After(JOURNAL_RETRY_MAX):
+			case <-UnmountWait():
+			}
+			continue
+		}
+
+		_start := time.Now()
+		err := JournalReplay(backend, entry)
+		if err != nil && JournalRetryable(err) {
+			// Writes made while waiting will be sent by the next try
+			journal_stop()
+			Log.WarningF("JournalConsumer: Failed to replay %s of %s, trying again in %s: %v", entry.Op, entry.GoogleId, wait, err)
+			// Do not hold up unmounting
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-UnmountWait():
+				timer.Stop()
+			}
+			wait *= 2
+			if wait > JOURNAL_RETRY_MAX {
+				wait = JOURNAL_RETRY_MAX
+			}
+			continue
+		}
+		if err != nil {
+			Log.ErrorF("JournalConsumer: Giving up on %s of %s, moving it to %s: %v", entry.Op, entry.GoogleId, JournalDeadBucket, err)
+			JournalGiveUp(key, entry, err)
+		} else {
+			JournalDone(key, entry)
+		}
+		wait = JOURNAL_RETRY_MIN
+		PrintCallDuration("JournalConsumer", &_start)
+	}
+}
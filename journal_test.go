@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+func journal_entries(t *testing.T) []JournalEntry {
+	entries := make([]JournalEntry, 0)
+	err := Store.View(func(tx StoreTx) error {
+		return tx.ForEach(JournalBucket, nil, func(k, v []byte) error {
+			entry := JournalEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to read the journal: %v", err)
+	}
+	return entries
+}
+
+func TestJournalAppendMerge(t *testing.T) {
+	test_store_reset()
+	JournalAppend(JournalEntry{Op: JournalOpCreate, GoogleId: "a", NewParent: "root"})
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "a"})
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "a"})
+	if entries := journal_entries(t); len(entries) != 1 {
+		t.Fatalf("Got %d entries instead of 1: %+v", len(entries), entries)
+	}
+
+	// Writes made while the file is uploaded must be uploaded again
+	key, entry, _ := journal_start()
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "a"})
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "a"})
+	if entries := journal_entries(t); len(entries) != 2 || entries[1].Op != JournalOpUpdate {
+		t.Fatalf("Got %+v instead of a create and an update", entries)
+	}
+	JournalDone(key, entry)
+	if entries := journal_entries(t); len(entries) != 1 || entries[0].Op != JournalOpUpdate {
+		t.Fatalf("Got %+v instead of an update", entries)
+	}
+	if !JournalPending("a") || JournalPending("root") {
+		t.Errorf("Only a should be pending")
+	}
+}
+
+func TestJournalAppendRemoveUnsent(t *testing.T) {
+	test_store_reset()
+	JournalAppend(JournalEntry{Op: JournalOpMkdir, GoogleId: "folder", NewParent: "root"})
+	JournalAppend(JournalEntry{Op: JournalOpCreate, GoogleId: "a", NewParent: "root"})
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "a"})
+	JournalAppend(JournalEntry{Op: JournalOpRename, GoogleId: "a", OldParent: "root", NewParent: "folder"})
+	JournalAppend(JournalEntry{Op: JournalOpRemove, GoogleId: "a", OldParent: "folder"})
+	if entries := journal_entries(t); len(entries) != 1 || entries[0].GoogleId != "folder" {
+		t.Fatalf("Got %+v instead of the mkdir of folder", entries)
+	}
+	if JournalPending("a") || !JournalPending("root") || !JournalPending("folder") {
+		t.Errorf("Only the mkdir of folder should be pending")
+	}
+	JournalAppend(JournalEntry{Op: JournalOpRemove, GoogleId: "folder", OldParent: "root"})
+	if entries := journal_entries(t); len(entries) != 0 {
+		t.Fatalf("Got %+v instead of an empty journal", entries)
+	}
+	if JournalPending("root") {
+		t.Errorf("root is still pending")
+	}
+
+	// A folder that still has files moved out of it must be created first
+	JournalAppend(JournalEntry{Op: JournalOpMkdir, GoogleId: "folder", NewParent: "root"})
+	JournalAppend(JournalEntry{Op: JournalOpRename, GoogleId: "b", OldParent: "folder", NewParent: "root"})
+	JournalAppend(JournalEntry{Op: JournalOpRemove, GoogleId: "folder", OldParent: "root"})
+	if entries := journal_entries(t); len(entries) != 3 {
+		t.Fatalf("Got %+v instead of 3 entries", entries)
+	}
+
+	// So must a file that is being created
+	test_store_reset()
+	JournalAppend(JournalEntry{Op: JournalOpCreate, GoogleId: "c", NewParent: "root"})
+	key, entry, _ := journal_start()
+	JournalAppend(JournalEntry{Op: JournalOpRemove, GoogleId: "c", OldParent: "root"})
+	JournalDone(key, entry)
+	if entries := journal_entries(t); len(entries) != 1 || entries[0].Op != JournalOpRemove {
+		t.Fatalf("Got %+v instead of the remove of c", entries)
+	}
+}
+
+func TestJournalRetryable(t *testing.T) {
+	rate_limit := &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}
+	forbidden := &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "insufficientFilePermissions"}}}
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 401}, true},
+		{&googleapi.Error{Code: 408}, true},
+		{&googleapi.Error{Code: 429}, true},
+		{rate_limit, true},
+		{forbidden, false},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, false},
+		{&RecoveredError{"oops"}, false},
+		{errors.New("connection reset by peer"), true},
+	}
+	for _, c := range cases {
+		if got := JournalRetryable(c.err); got != c.retryable {
+			t.Errorf("JournalRetryable(%v) is %v instead of %v", c.err, got, c.retryable)
+		}
+	}
+}
+
+func TestJournalGiveUp(t *testing.T) {
+	test_store_reset()
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: "a"})
+	key, entry, _ := journal_start()
+	JournalGiveUp(key, entry, &googleapi.Error{Code: 400, Message: "bad"})
+	if entries := journal_entries(t); len(entries) != 0 {
+		t.Fatalf("Got %+v instead of an empty journal", entries)
+	}
+	// The local copy must stay as it is
+	if !JournalPending("a") {
+		t.Errorf("a is no longer pending")
+	}
+	dead := 0
+	Store.View(func(tx StoreTx) error {
+		return tx.ForEach(JournalDeadBucket, nil, func(k, v []byte) error {
+			dead++
+			return nil
+		})
+	})
+	if dead != 1 {
+		t.Errorf("Got %d entries on %s instead of 1", dead, JournalDeadBucket)
+	}
+
+	// Its folder must not stay pending though
+	JournalAppend(JournalEntry{Op: JournalOpCreate, GoogleId: "b", NewParent: "root"})
+	key, entry, _ = journal_start()
+	JournalGiveUp(key, entry, &googleapi.Error{Code: 400, Message: "bad"})
+	if !JournalPending("b") || JournalPending("root") {
+		t.Errorf("Only b should be pending")
+	}
+}
+
+// Fails to create anything as if Google Drive could not be reached.
+type journal_offline_backend struct {
+	DriveBackend
+	calls chan bool
+}
+
+func (b *journal_offline_backend) Create(file *drive.File, media io.Reader) (*drive.File, error) {
+	b.calls <- true
+	return nil, errors.New("dial tcp: network is unreachable")
+}
+
+func TestJournalConsumerUnmount(t *testing.T) {
+	test_store_reset()
+	test_unmount_reset()
+	defer test_unmount_reset()
+	b := &journal_offline_backend{calls: make(chan bool, 1)}
+	JournalAppend(JournalEntry{Op: JournalOpMkdir, GoogleId: "a", Name: "a", NewParent: "root"})
+	done := make(chan bool)
+	go func() {
+		JournalConsumer(b)
+		close(done)
+	}()
+
+	// Unmounting while waiting to try again
+	<-b.calls
+	StartUnmounting()
+	select {
+	case <-done:
+	case <-time.After(JOURNAL_RETRY_MIN / 2):
+		t.Fatalf("JournalConsumer kept waiting after unmounting")
+	}
+	if !JournalPending("a") {
+		t.Errorf("The entry that failed was dropped")
+	}
+}
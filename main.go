@@ -2,12 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/gjvnq/go-logger"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -16,21 +17,61 @@ import (
 )
 
 var RootNode = &MDNode{}
-var DB *bolt.DB
 var FSConn *nodefs.FileSystemConnector
 var FUSEServer *fuse.Server
 var Inode2Id *map_uint64_string
-var Unmounting bool
 var CacheDir string
 var MemCache *cache.Cache
 var Log *logger.Logger
 var HackPoint *os.File
+var DeletePermanently bool
+
+// Closed once MegaDrive starts unmounting. Use Unmounting to check it and UnmountWait to wait on it.
+var unmount_ch = make(chan bool)
+var unmount_mux = new(sync.Mutex)
+
+// Returns a channel that is closed once MegaDrive starts unmounting, so consumers can stop sleeping right away.
+func UnmountWait() <-chan bool {
+	unmount_mux.Lock()
+	defer unmount_mux.Unlock()
+	return unmount_ch
+}
+
+// Tells whether MegaDrive is being unmounted.
+func Unmounting() bool {
+	select {
+	case <-UnmountWait():
+		return true
+	default:
+		return false
+	}
+}
+
+// Makes Unmounting return true and wakes up everything waiting on UnmountWait.
+func StartUnmounting() {
+	unmount_mux.Lock()
+	defer unmount_mux.Unlock()
+	select {
+	case <-unmount_ch:
+	default:
+		close(unmount_ch)
+	}
+}
 
 func PrintCallDuration(prefix string, start *time.Time) {
 	elapsed := time.Since(*start)
 	Log.DebugNF(1, "%s: I took %s", prefix, elapsed)
 }
 
+// What the "Save ourselves" defers return when they catch a panic.
+type RecoveredError struct {
+	Value interface{}
+}
+
+func (e *RecoveredError) Error() string {
+	return fmt.Sprintf("recovered: %+v", e.Value)
+}
+
 func main() {
 	var err error
 	// Set a few variables
@@ -45,10 +86,42 @@ func main() {
 	// Get CLI options
 	fuse_debug := flag.Bool("fuse-debug", false, "print debugging messages.")
 	other := flag.Bool("allow-other", false, "mount with -o allowother.")
+	flag.Int64Var(&CacheMaxBytes, "cache-max-bytes", 0, "evict least recently used files once the cache is bigger than this (0 means no limit).")
+	flag.IntVar(&CacheMaxFiles, "cache-max-files", 0, "evict least recently used files once the cache has more files than this (0 means no limit).")
+	store_kind := flag.String("store", "bolt", "where to keep metadata: bolt, sqlite or memory.")
+	drive_endpoint := flag.String("drive-endpoint", "", "talk to this Drive v3 endpoint (like the one started by \"MegaDrive stand-in DIR\") instead of Google Drive.")
+	read_blocks := flag.Bool("read-blocks", true, "download only the parts of files that are read; if false, files are downloaded whole and read while they arrive, so reads are served before the download is checked against its MD5.")
+	verify_cache := flag.Bool("verify-cache", false, "check every cached file against its MD5 when mounting.")
+	flag.BoolVar(&DeletePermanently, "delete-permanently", false, "delete removed files instead of moving them to the trash.")
+	export_document := flag.String("export-document", DriveExportFormats[MimeTypeGoogleDocument], "format Google Docs are exported as (docx, odt or pdf).")
+	export_spreadsheet := flag.String("export-spreadsheet", DriveExportFormats[MimeTypeGoogleSpreadsheet], "format Google Sheets are exported as (xlsx, ods or csv).")
+	export_presentation := flag.String("export-presentation", DriveExportFormats[MimeTypeGooglePresentation], "format Google Slides are exported as (pptx or pdf).")
+	export_drawing := flag.String("export-drawing", DriveExportFormats[MimeTypeGoogleDrawing], "format Google Drawings are exported as (svg or png).")
 	flag.Parse()
+	SetReadBlocks(*read_blocks)
+	for mime_type, ext := range map[string]string{
+		MimeTypeGoogleDocument:     *export_document,
+		MimeTypeGoogleSpreadsheet:  *export_spreadsheet,
+		MimeTypeGooglePresentation: *export_presentation,
+		MimeTypeGoogleDrawing:      *export_drawing,
+	} {
+		if err := DriveSetExportFormat(mime_type, ext); err != nil {
+			Log.FatalF("Invalid export format: %v", err)
+		}
+	}
+	switch flag.Arg(0) {
+	case "pin", "unpin":
+		os.Exit(PinCommand(flag.Arg(0), flag.Args()[1:]))
+	case "verify":
+		os.Exit(VerifyCommand(flag.Args()[1:]))
+	case "gc":
+		os.Exit(GcCommand(flag.Args()[1:]))
+	case "stand-in":
+		os.Exit(StandInCommand(flag.Args()[1:]))
+	}
 	mount_point := flag.Arg(0)
 	if len(flag.Args()) < 1 {
-		Log.FatalF("Usage:\n  MegaDrive MOUNTPOINT")
+		Log.FatalF("Usage:\n  MegaDrive MOUNTPOINT\n  MegaDrive pin PATH...\n  MegaDrive unpin PATH...\n  MegaDrive verify PATH...\n  MegaDrive gc MOUNTPOINT\n  MegaDrive stand-in DIR")
 	}
 	mount_point, _ = filepath.Abs(mount_point)
 	mount_base := filepath.Base(mount_point)
@@ -66,6 +139,9 @@ func main() {
 	os.MkdirAll(CacheDir, 0755)
 	os.MkdirAll(PathInCache("config"), 0755)
 	os.MkdirAll(PathInCache("nodes"), 0755)
+	// Downloads that were interrupted are useless
+	os.RemoveAll(PathInCache("tmp"))
+	os.MkdirAll(PathInCache("tmp"), 0755)
 	MemCache = cache.New(15*time.Minute, 30*time.Minute)
 
 	// Mount fs
@@ -74,28 +150,27 @@ func main() {
 		Log.FatalF("Mount fail: %v", err)
 	}
 
-	// Load bolt
-	DB, err = bolt.Open(CacheDir+"bolt.db", 0600, nil)
+	// Load metadata store
+	Store, err = OpenStore(*store_kind)
 	if err != nil {
 		Log.Fatal(err.Error())
 	}
-	defer DB.Close()
-	DB.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(StdBucket)
-		return err
-	})
+	defer Store.Close()
+	BasicsMigrate()
+	DriveExportCheckFormats()
 
 	// Load Google Drive
-	DriveClient = GetDriveClient()
+	backend := NewDriveServiceBackend(GetDriveClient(*drive_endpoint))
+	RootNode.backend = backend
 
 	// Prepare to deal with ctrl+c
 	sig_chan := make(chan os.Signal, 20)
 	signal.Notify(sig_chan, os.Interrupt)
 	go func() {
 		for _ = range sig_chan {
-			Unmounting = true
+			StartUnmounting()
 			Log.Notice("Closing DB...")
-			err := DB.Close()
+			err := Store.Close()
 			if err != nil {
 				Log.ErrorF("Failed to close DB: %v", err)
 			} else {
@@ -112,17 +187,30 @@ func main() {
 		}
 	}()
 
-	// Start consumers
-	for i := 0; i < 3; i++ {
-		go DriveGetBasicsConsumer()
-		go DriveOpenDirConsumer()
-		go DriveReadConsumer()
+	StartConsumers(backend)
+	if *verify_cache {
+		go CacheVerifyAll()
 	}
 	// Pre Cache
 	Log.Notice("Pre-caching...")
 	// DriveOpenDir("root") <---- Problem
-	DriveOpenDirConsumerCore("root")
+	DriveOpenDirConsumerCore(backend, "root")
 	// Start things
 	Log.Notice("Serving...")
 	FUSEServer.Serve()
 }
+
+func StartConsumers(backend DriveBackend) {
+	for i := 0; i < 3; i++ {
+		go DriveGetBasicsConsumer(backend)
+		go DriveOpenDirConsumer(backend)
+		go DriveReadConsumer(backend)
+	}
+	// Only one, so the journal is replayed in order
+	go JournalConsumer(backend)
+	go PinConsumer()
+	go CacheEvictConsumer()
+	go ChangesConsumer(backend)
+	go NotifyConsumer()
+	go GcConsumer()
+}
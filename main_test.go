@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gjvnq/go-logger"
+	"google.golang.org/api/drive/v3"
+)
+
+// Tests log to MEGADRIVE_TEST_LOG if set, otherwise nowhere.
+func TestMain(m *testing.M) {
+	out := ioutil.Discard
+	if path := os.Getenv("MEGADRIVE_TEST_LOG"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	var err error
+	if Log, err = logger.New("test", 0, out); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// The consumers never stop, so they are only started once (go test -count=N runs every test N times) and always reach the fake Drive of the test that is running. The journal, pins, eviction, changes and garbage collection are left to the tests themselves, so they can check every step.
+type test_backend struct {
+	backend DriveBackend
+	mux     sync.Mutex
+}
+
+var TestBackend = &test_backend{}
+var TestConsumers sync.Once
+
+// Makes the consumers talk to b, starting them if needed.
+func test_consumers(b DriveBackend) {
+	TestBackend.mux.Lock()
+	TestBackend.backend = b
+	TestBackend.mux.Unlock()
+	TestConsumers.Do(func() {
+		for i := 0; i < 3; i++ {
+			go DriveGetBasicsConsumer(TestBackend)
+			go DriveOpenDirConsumer(TestBackend)
+			go DriveReadConsumer(TestBackend)
+		}
+		go NotifyConsumer()
+	})
+}
+
+// Waits until the consumers are done with whatever an earlier test left them, so the next one can swap CacheDir, MemCache and Store.
+func test_consumers_idle() {
+	idle := 0
+	for i := 0; i < 500 && idle < 3; i++ {
+		if test_consumers_busy() {
+			idle = 0
+		} else {
+			idle++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func test_consumers_busy() bool {
+	for _, ch := range []chan string{ChBasicInfoReq, ChBasicInfoReqLP, ChOpenDirReq, ChOpenDirReqLP, ChReadReq, ChReadReqLP} {
+		if len(ch) > 0 {
+			return true
+		}
+	}
+	if Store == nil {
+		return false
+	}
+	for _, key := range CKeysPrefix("") {
+		if strings.HasSuffix(key, ":!WorkTimeout") || strings.HasSuffix(key, ":!working") && CGetDef_bool(key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gives the test an empty Store once nothing else uses the old one.
+func test_store_reset() {
+	test_consumers_idle()
+	Store = NewMemoryStore()
+}
+
+// Forgets the nodes of a mount point that is gone. Otherwise NotifyConsumer keeps writing to its /dev/fuse descriptor, which by then may be a file another test opened.
+func test_nodes_reset() {
+	MapIdNodesMux.Lock()
+	defer MapIdNodesMux.Unlock()
+	MapIdNodes = make(map[string]map[*MDNode]bool)
+}
+
+// Lets MegaDrive unmount again.
+func test_unmount_reset() {
+	unmount_mux.Lock()
+	defer unmount_mux.Unlock()
+	unmount_ch = make(chan bool)
+}
+
+func (b *test_backend) get() DriveBackend {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.backend
+}
+
+func (b *test_backend) Get(google_id string) (*drive.File, error) {
+	return b.get().Get(google_id)
+}
+
+func (b *test_backend) List(parent_id string) ([]*drive.File, error) {
+	return b.get().List(parent_id)
+}
+
+func (b *test_backend) Download(google_id string, start, end int64) (io.ReadCloser, bool, error) {
+	return b.get().Download(google_id, start, end)
+}
+
+func (b *test_backend) Export(google_id, mime_type string) (io.ReadCloser, error) {
+	return b.get().Export(google_id, mime_type)
+}
+
+func (b *test_backend) Create(file *drive.File, media io.Reader) (*drive.File, error) {
+	return b.get().Create(file, media)
+}
+
+func (b *test_backend) Update(google_id string, file *drive.File, media io.Reader, add_parent, remove_parent string) (*drive.File, error) {
+	return b.get().Update(google_id, file, media, add_parent, remove_parent)
+}
+
+func (b *test_backend) Delete(google_id string, permanently bool) error {
+	return b.get().Delete(google_id, permanently)
+}
+
+func (b *test_backend) GenerateIds(count int) ([]string, error) {
+	return b.get().GenerateIds(count)
+}
+
+func (b *test_backend) StartPageToken() (string, error) {
+	return b.get().StartPageToken()
+}
+
+func (b *test_backend) Changes(page_token string) ([]*drive.Change, string, string, error) {
+	return b.get().Changes(page_token)
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/patrickmn/go-cache"
+	"google.golang.org/api/drive/v3"
+)
+
+// Every file on the fake Drive has this mtime, so GetAttr can be checked.
+var MOUNT_TEST_TIME = time.Date(2020, 2, 20, 20, 20, 20, 0, time.UTC)
+
+// RootNode mounted on a temporary folder against a FakeDriveBackend. The tests go through the mount point like any other program would, so Lookup, GetAttr, OpenDir, Read and the xattrs are checked through the kernel.
+type mount_fixture struct {
+	mount_point string
+	fake        *FakeDriveBackend
+	// Files on the fake Drive by the path they should have on the mount point
+	files map[string]*drive.File
+	// Contents by the same paths
+	contents map[string][]byte
+}
+
+func TestMount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("/dev/fuse is missing")
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("fusermount is missing")
+	}
+	m := mount_fake_drive(t)
+	t.Run("ls", m.test_ls)
+	t.Run("stat", m.test_stat)
+	t.Run("stat missing", m.test_stat_missing)
+	t.Run("read range", m.test_read_range)
+	t.Run("read stream", m.test_read_stream)
+	t.Run("read stream early", m.test_read_stream_early)
+	t.Run("cat", m.test_cat)
+	t.Run("reopen", m.test_reopen)
+	t.Run("export", m.test_export)
+	t.Run("rename export", m.test_rename_export)
+	t.Run("duplicate names", m.test_duplicates)
+	t.Run("xattrs", m.test_xattrs)
+	t.Run("create", m.test_create)
+	t.Run("create unlink", m.test_create_unlink)
+	t.Run("write", m.test_write)
+	t.Run("mkdir", m.test_mkdir)
+	t.Run("unlink", m.test_unlink)
+	t.Run("rename", m.test_rename)
+	t.Run("unmount", m.test_unmount)
+}
+
+// Fills a fake Drive and mounts it with its cache on a temporary folder.
+func mount_fake_drive(t *testing.T) *mount_fixture {
+	tmp := t.TempDir()
+	m := &mount_fixture{
+		mount_point: filepath.Join(tmp, "mnt"),
+		fake:        NewFakeDriveBackend(),
+		files:       make(map[string]*drive.File),
+		contents:    make(map[string][]byte),
+	}
+	m.fake.Now = func() time.Time { return MOUNT_TEST_TIME }
+	big := make([]byte, 3*READ_BLOCK_SIZE+123)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	docs := m.fake.Put("root", "docs", MimeTypeGoogleFolder, nil)
+	m.files["docs"] = docs
+	m.add("root", "", "hello.txt", "text/plain", []byte("Hello, MegaDrive!\n"))
+	m.add("root", "", "a/b.txt", "text/plain", []byte("slashes are not allowed in names\n"))
+	m.add("root", "", "big.bin", "application/octet-stream", big)
+	m.add("root", "", "stream.bin", "application/octet-stream", big[READ_BLOCK_SIZE:])
+	m.add("root", "", "slow.bin", "application/octet-stream", big[:2*READ_BLOCK_SIZE])
+	m.add("root", "", "notes", MimeTypeGoogleDocument, []byte("exported notes\n"))
+	m.add(docs.Id, "docs/", "same.txt", "text/plain", []byte("first\n"))
+	m.add(docs.Id, "docs/", "same.txt", "text/plain", []byte("second\n"))
+	m.add(docs.Id, "docs/", "report.txt", "text/plain", []byte("report\n"))
+
+	test_consumers_idle()
+	CacheDir = filepath.Join(tmp, "cache") + "/"
+	os.MkdirAll(m.mount_point, 0755)
+	os.MkdirAll(PathInCache("tmp"), 0755)
+	MemCache = cache.New(15*time.Minute, 30*time.Minute)
+	Store = NewMemoryStore()
+	test_unmount_reset()
+	RootNode.GoogleId = "root"
+	RootNode.backend = m.fake
+
+	var err error
+	FSConn = nodefs.NewFileSystemConnector(RootNode, &nodefs.Options{})
+	FUSEServer, err = fuse.NewServer(FSConn.RawFS(), m.mount_point, &fuse.MountOptions{
+		Name:   "MegaDrive",
+		FsName: m.mount_point,
+	})
+	if err != nil {
+		t.Fatalf("Failed to mount: %v", err)
+	}
+	// Never leave a mount point behind, even if a test fails, and let the tests that follow run as if nothing was unmounted
+	t.Cleanup(func() {
+		if !Unmounting() {
+			StartUnmounting()
+			FUSEServer.Unmount()
+		}
+		test_nodes_reset()
+		test_unmount_reset()
+	})
+	test_consumers(m.fake)
+	DriveOpenDirConsumerCore(m.fake, "root")
+	go FUSEServer.Serve()
+	if err := FUSEServer.WaitMount(); err != nil {
+		t.Fatalf("Failed to mount: %v", err)
+	}
+	return m
+}
+
+// Puts a file on the fake Drive and remembers the path it should show up as. Files with the same name get their unambiguous names.
+func (m *mount_fixture) add(parent_id, dir, name, mime_type string, content []byte) {
+	file := m.fake.Put(parent_id, name, mime_type, content)
+	path := dir + DriveSanitizeName(name, mime_type)
+	if old, found := m.files[path]; found {
+		delete(m.files, path)
+		m.files[dir+DriveUnambiguousName(old.Id, old.Name, old.MimeType)] = old
+		m.contents[dir+DriveUnambiguousName(old.Id, old.Name, old.MimeType)] = m.contents[path]
+		path = dir + DriveUnambiguousName(file.Id, name, mime_type)
+	}
+	m.files[path] = file
+	m.contents[path] = content
+}
+
+func (m *mount_fixture) path(name string) string {
+	return filepath.Join(m.mount_point, name)
+}
+
+// Returns the names (with a "/" after folders) on dir of the mount point.
+func (m *mount_fixture) ls(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(m.path(dir))
+	if err != nil {
+		t.Fatalf("ls %s: %v", dir, err)
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name()+"/")
+		} else {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
+
+// Returns what ls should return for dir.
+func (m *mount_fixture) expected_ls(dir string) []string {
+	names := make([]string, 0)
+	for path, file := range m.files {
+		if filepath.Dir(path) != filepath.Clean(dir) {
+			continue
+		}
+		if file.MimeType == MimeTypeGoogleFolder {
+			names = append(names, filepath.Base(path)+"/")
+		} else {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *mount_fixture) test_ls(t *testing.T) {
+	if names, expected := m.ls(t, "."), m.expected_ls("."); !same_strings(names, expected) {
+		t.Errorf("Got %q instead of %q", names, expected)
+	}
+}
+
+func (m *mount_fixture) test_stat(t *testing.T) {
+	for path, file := range m.files {
+		info, err := os.Stat(m.path(path))
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if is_dir := file.MimeType == MimeTypeGoogleFolder; info.IsDir() != is_dir {
+			t.Errorf("%s: IsDir is %v instead of %v", path, info.IsDir(), is_dir)
+		}
+		if !info.ModTime().Equal(MOUNT_TEST_TIME) {
+			t.Errorf("%s: mtime is %s instead of %s", path, info.ModTime(), MOUNT_TEST_TIME)
+		}
+		// Google Drive does not know how big exported files are until they are downloaded
+		if _, export := DriveExportMimeType(file.MimeType); !info.IsDir() && !export && info.Size() != int64(len(m.contents[path])) {
+			t.Errorf("%s: size is %d instead of %d", path, info.Size(), len(m.contents[path]))
+		}
+	}
+}
+
+func (m *mount_fixture) test_stat_missing(t *testing.T) {
+	if _, err := os.Stat(m.path("missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("Got %v instead of ENOENT", err)
+	}
+}
+
+func (m *mount_fixture) test_cat(t *testing.T) {
+	for path, file := range m.files {
+		if _, export := DriveExportMimeType(file.MimeType); export || file.MimeType == MimeTypeGoogleFolder {
+			continue
+		}
+		content, err := ioutil.ReadFile(m.path(path))
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !bytes.Equal(content, m.contents[path]) {
+			t.Errorf("%s: got %d bytes that differ from the %d on the fake Drive", path, len(content), len(m.contents[path]))
+		}
+	}
+}
+
+// A newer version is only seen by handles opened after it was saved.
+func (m *mount_fixture) test_reopen(t *testing.T) {
+	old := m.contents["hello.txt"]
+	f, err := os.Open(m.path("hello.txt"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+
+	// Same size, so the kernel has no reason to look again
+	id := m.files["hello.txt"].Id
+	updated := []byte(strings.ToUpper(string(old)))
+	if _, err := m.fake.Update(id, &drive.File{}, bytes.NewReader(updated), "", ""); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if sts := DriveGetBasicsConsumerCore(m.fake, id); sts != fuse.OK {
+		t.Fatalf("DriveGetBasicsConsumerCore returned %v", sts)
+	}
+	if sts := DriveReadConsumerCore(m.fake, id); sts != fuse.OK {
+		t.Fatalf("DriveReadConsumerCore returned %v", sts)
+	}
+	m.contents["hello.txt"] = updated
+
+	buf := make([]byte, len(old))
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(buf, old) {
+		t.Errorf("The open file has %q instead of %q", buf, old)
+	}
+	content, err := ioutil.ReadFile(m.path("hello.txt"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(content, updated) {
+		t.Errorf("Opening again gave %q instead of %q", content, updated)
+	}
+}
+
+// Reads a piece from the middle of a file that was not read before, so DriveReadRange only downloads some blocks.
+func (m *mount_fixture) test_read_range(t *testing.T) {
+	f, err := os.Open(m.path("big.bin"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	off := int64(2*READ_BLOCK_SIZE + 7)
+	buf := make([]byte, 100)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := m.contents["big.bin"][off : off+100]; !bytes.Equal(buf, expected) {
+		t.Errorf("Got %v instead of %v", buf, expected)
+	}
+}
+
+// Reads a file that was not read before through DriveReadStream.
+func (m *mount_fixture) test_read_stream(t *testing.T) {
+	SetReadBlocks(false)
+	defer SetReadBlocks(true)
+	content, err := ioutil.ReadFile(m.path("stream.bin"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(content, m.contents["stream.bin"]) {
+		t.Errorf("Got %d bytes that differ from the %d on the fake Drive", len(content), len(m.contents["stream.bin"]))
+	}
+	if CFound("Block:" + m.files["stream.bin"].Id + ":!bitmap") {
+		t.Errorf("stream.bin was read in blocks")
+	}
+}
+
+// Downloads that stop after their first bytes until release is closed.
+type mount_gated_backend struct {
+	DriveBackend
+	first   int
+	release chan bool
+}
+
+type mount_gated_reader struct {
+	io.ReadCloser
+	left    int
+	release chan bool
+}
+
+func (b *mount_gated_backend) Download(google_id string, start, end int64) (io.ReadCloser, bool, error) {
+	body, partial, err := b.DriveBackend.Download(google_id, start, end)
+	if err != nil {
+		return nil, false, err
+	}
+	return &mount_gated_reader{body, b.first, b.release}, partial, nil
+}
+
+func (r *mount_gated_reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		<-r.release
+		r.left = -1
+	}
+	if r.left > 0 && len(p) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.left > 0 {
+		r.left -= n
+	}
+	return n, err
+}
+
+// The point of streaming: the start of a file can be read before the rest of it is downloaded.
+func (m *mount_fixture) test_read_stream_early(t *testing.T) {
+	SetReadBlocks(false)
+	defer SetReadBlocks(true)
+	gated := &mount_gated_backend{m.fake, READ_BLOCK_SIZE, make(chan bool)}
+	test_consumers(gated)
+	defer test_consumers(m.fake)
+	released := false
+	defer func() {
+		if !released {
+			close(gated.release)
+		}
+	}()
+
+	f, err := os.Open(m.path("slow.bin"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	content := m.contents["slow.bin"]
+	done := make(chan error, 1)
+	buf := make([]byte, 4096)
+	go func() {
+		_, err := f.ReadAt(buf, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || !bytes.Equal(buf, content[:len(buf)]) {
+			t.Errorf("Reading the start of slow.bin returned %v or bytes that differ from the fake Drive", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The start of slow.bin was not served before the rest was downloaded")
+	}
+	if CFound("Read:" + m.files["slow.bin"].Id + ":!ret") {
+		t.Errorf("slow.bin was downloaded before it was released")
+	}
+
+	close(gated.release)
+	released = true
+	got, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Got %d bytes (%v) that differ from the %d on the fake Drive", len(got), err, len(content))
+	}
+}
+
+func (m *mount_fixture) test_export(t *testing.T) {
+	path := DriveSanitizeName("notes", MimeTypeGoogleDocument)
+	content, err := ioutil.ReadFile(m.path(path))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(content, m.contents[path]) {
+		t.Errorf("Got %q instead of %q", content, m.contents[path])
+	}
+}
+
+// Exported files keep the extension of the format they are exported as, whatever they are renamed to.
+func (m *mount_fixture) test_rename_export(t *testing.T) {
+	path := DriveSanitizeName("notes", MimeTypeGoogleDocument)
+	id := m.files[path].Id
+	if err := os.Rename(m.path(path), m.path("memo.odt")); err != nil {
+		t.Fatalf("Renaming %s failed: %v", path, err)
+	}
+	entries := journal_entries(t)
+	if len(entries) != 1 || entries[0].Op != JournalOpRename || entries[0].GoogleId != id || entries[0].Name != "memo" {
+		t.Fatalf("Got %+v instead of the rename of %s to memo", entries, id)
+	}
+	renamed := DriveSanitizeName("memo", MimeTypeGoogleDocument)
+	if _, err := os.Stat(m.path(renamed)); err != nil {
+		t.Errorf("Stat of %s: %v", renamed, err)
+	}
+	m.replay(t)
+	if file, _ := m.uploaded(t, id); file.Name != "memo" {
+		t.Errorf("%s is called %q on the fake Drive instead of memo", id, file.Name)
+	}
+
+	// Back to how it was, with yet another extension
+	if err := os.Rename(m.path(renamed), m.path("notes.pdf")); err != nil {
+		t.Fatalf("Renaming %s failed: %v", renamed, err)
+	}
+	m.replay(t)
+	if file, _ := m.uploaded(t, id); file.Name != "notes" {
+		t.Errorf("%s is called %q on the fake Drive instead of notes", id, file.Name)
+	}
+	if names, expected := m.ls(t, "."), m.expected_ls("."); !same_strings(names, expected) {
+		t.Errorf("Got %q instead of %q", names, expected)
+	}
+}
+
+func (m *mount_fixture) test_duplicates(t *testing.T) {
+	names, expected := m.ls(t, "docs"), m.expected_ls("docs")
+	if !same_strings(names, expected) {
+		t.Fatalf("Got %q instead of %q", names, expected)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "same.txt (") {
+			continue
+		}
+		content, err := ioutil.ReadFile(m.path("docs/" + name))
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if !bytes.Equal(content, m.contents["docs/"+name]) {
+			t.Errorf("%s: got %q instead of %q", name, content, m.contents["docs/"+name])
+		}
+	}
+}
+
+func mount_getxattr(path, attr string) (string, error) {
+	buf := make([]byte, 256)
+	size, err := syscall.Getxattr(path, attr, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+func (m *mount_fixture) test_xattrs(t *testing.T) {
+	path := m.path("hello.txt")
+	file := m.files["hello.txt"]
+	if v, err := mount_getxattr(path, "user.google-id"); err != nil || v != file.Id {
+		t.Errorf("user.google-id is %q (%v) instead of %q", v, err, file.Id)
+	}
+	if v, err := mount_getxattr(path, "user.mime"); err != nil || v != file.MimeType {
+		t.Errorf("user.mime is %q (%v) instead of %q", v, err, file.MimeType)
+	}
+	buf := make([]byte, 256)
+	size, err := syscall.Listxattr(path, buf)
+	if err != nil {
+		t.Fatalf("listxattr: %v", err)
+	}
+	attrs := strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00")
+	if !same_strings(attrs, []string{"user.google-id", "user.mime"}) {
+		t.Errorf("listxattr returned %q", attrs)
+	}
+	// Pinning goes through SetXAttr and RemoveXAttr
+	if err := syscall.Setxattr(path, PIN_XATTR, []byte("1"), 0); err != nil {
+		t.Fatalf("setxattr %s: %v", PIN_XATTR, err)
+	}
+	if v, err := mount_getxattr(path, PIN_XATTR); err != nil || v != "1" {
+		t.Errorf("%s is %q (%v) after pinning", PIN_XATTR, v, err)
+	}
+	if err := syscall.Removexattr(path, PIN_XATTR); err != nil {
+		t.Fatalf("removexattr %s: %v", PIN_XATTR, err)
+	}
+	if _, err := mount_getxattr(path, PIN_XATTR); err != syscall.ENODATA {
+		t.Errorf("%s gave %v instead of ENODATA after unpinning", PIN_XATTR, err)
+	}
+}
+
+// Sends the journal to the fake Drive, as JournalConsumer does once it is online.
+func (m *mount_fixture) replay(t *testing.T) {
+	for {
+		key, entry, found := journal_start()
+		if !found {
+			return
+		}
+		if err := JournalReplay(m.fake, entry); err != nil {
+			journal_stop()
+			t.Fatalf("Replaying %+v failed: %v", entry, err)
+		}
+		JournalDone(key, entry)
+	}
+}
+
+// Returns what the fake Drive has for google_id.
+func (m *mount_fixture) uploaded(t *testing.T, google_id string) (*drive.File, []byte) {
+	file, err := m.fake.Get(google_id)
+	if err != nil {
+		t.Fatalf("%s is not on the fake Drive: %v", google_id, err)
+	}
+	body, _, err := m.fake.Download(google_id, 0, -1)
+	if err != nil {
+		return file, nil
+	}
+	defer body.Close()
+	content, _ := ioutil.ReadAll(body)
+	return file, content
+}
+
+func (m *mount_fixture) test_create(t *testing.T) {
+	path := m.path("new.txt")
+	content := []byte("written on the mount point\n")
+	before := time.Now().Truncate(time.Second)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Writing %s failed: %v", path, err)
+	}
+	id, err := mount_getxattr(path, "user.google-id")
+	if err != nil {
+		t.Fatalf("user.google-id of %s: %v", path, err)
+	}
+	entries := journal_entries(t)
+	if len(entries) != 1 || entries[0].Op != JournalOpCreate || entries[0].GoogleId != id || entries[0].Name != "new.txt" || entries[0].NewParent != "root" {
+		t.Fatalf("Got %+v instead of the creation of %s", entries, id)
+	}
+	// The size and time of the local copy are shown until it is uploaded
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len(content)) || info.ModTime().Before(before) {
+		t.Errorf("Stat of %s returned %+v, %v", path, info, err)
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Reading %s returned %q, %v", path, got, err)
+	}
+
+	m.replay(t)
+	file, got := m.uploaded(t, id)
+	if file.Name != "new.txt" || !bytes.Equal(got, content) {
+		t.Errorf("Uploaded %+v with %q instead of %q", file, got, content)
+	}
+	m.files["new.txt"] = file
+	m.contents["new.txt"] = content
+	if names, expected := m.ls(t, "."), m.expected_ls("."); !same_strings(names, expected) {
+		t.Errorf("Got %q instead of %q", names, expected)
+	}
+}
+
+// Editors create and remove files all the time (vim's 4913, for one). Nothing is sent if they are gone before Google Drive could be reached.
+func (m *mount_fixture) test_create_unlink(t *testing.T) {
+	path := m.path("4913")
+	if err := ioutil.WriteFile(path, []byte("probe"), 0644); err != nil {
+		t.Fatalf("Writing %s failed: %v", path, err)
+	}
+	id, err := mount_getxattr(path, "user.google-id")
+	if err != nil {
+		t.Fatalf("user.google-id of %s: %v", path, err)
+	}
+	if entries := journal_entries(t); len(entries) != 1 || entries[0].Op != JournalOpCreate || entries[0].GoogleId != id {
+		t.Fatalf("Got %+v instead of the creation of %s", entries, id)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Removing %s failed: %v", path, err)
+	}
+	if entries := journal_entries(t); len(entries) != 0 {
+		t.Errorf("Got %+v instead of an empty journal", entries)
+	}
+	if JournalPending(id) || JournalPending("root") {
+		t.Errorf("%s or its folder is still pending", id)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Stat of %s gave %v after removing it", path, err)
+	}
+	if names, expected := m.ls(t, "."), m.expected_ls("."); !same_strings(names, expected) {
+		t.Errorf("Got %q instead of %q", names, expected)
+	}
+}
+
+func (m *mount_fixture) test_write(t *testing.T) {
+	path := m.path("hello.txt")
+	id := m.files["hello.txt"].Id
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Opening %s failed: %v", path, err)
+	}
+	if _, err := f.WriteString("Written back!\n"); err != nil {
+		t.Fatalf("Writing %s failed: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Closing %s failed: %v", path, err)
+	}
+	content := append(append([]byte{}, m.contents["hello.txt"]...), "Written back!\n"...)
+	if entries := journal_entries(t); len(entries) != 1 || entries[0].Op != JournalOpUpdate || entries[0].GoogleId != id {
+		t.Fatalf("Got %+v instead of the update of %s", entries, id)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(content)) {
+		t.Errorf("Stat of %s returned %+v, %v", path, info, err)
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Reading %s returned %q, %v", path, got, err)
+	}
+
+	m.replay(t)
+	if _, got := m.uploaded(t, id); !bytes.Equal(got, content) {
+		t.Errorf("Uploaded %q instead of %q", got, content)
+	}
+	m.contents["hello.txt"] = content
+}
+
+// Files can be created inside a folder before the folder reaches Google Drive.
+func (m *mount_fixture) test_mkdir(t *testing.T) {
+	if err := os.Mkdir(m.path("made"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	id, err := mount_getxattr(m.path("made"), "user.google-id")
+	if err != nil {
+		t.Fatalf("user.google-id of made: %v", err)
+	}
+	content := []byte("inside\n")
+	if err := ioutil.WriteFile(m.path("made/inside.txt"), content, 0644); err != nil {
+		t.Fatalf("Writing made/inside.txt failed: %v", err)
+	}
+	entries := journal_entries(t)
+	if len(entries) != 2 || entries[0].Op != JournalOpMkdir || entries[0].GoogleId != id || entries[0].Name != "made" || entries[0].NewParent != "root" ||
+		entries[1].Op != JournalOpCreate || entries[1].NewParent != id {
+		t.Fatalf("Got %+v instead of the creation of made and made/inside.txt", entries)
+	}
+	if info, err := os.Stat(m.path("made")); err != nil || !info.IsDir() {
+		t.Errorf("Stat of made returned %+v, %v", info, err)
+	}
+	if names := m.ls(t, "made"); !same_strings(names, []string{"inside.txt"}) {
+		t.Errorf("Got %q inside made", names)
+	}
+
+	m.replay(t)
+	folder, _ := m.uploaded(t, id)
+	file, got := m.uploaded(t, entries[1].GoogleId)
+	if folder.Name != "made" || folder.MimeType != MimeTypeGoogleFolder || len(file.Parents) != 1 || file.Parents[0] != id || !bytes.Equal(got, content) {
+		t.Errorf("Uploaded %+v and %+v with %q", folder, file, got)
+	}
+	m.files["made"] = folder
+	m.files["made/inside.txt"] = file
+	m.contents["made/inside.txt"] = content
+	if names, expected := m.ls(t, "."), m.expected_ls("."); !same_strings(names, expected) {
+		t.Errorf("Got %q instead of %q", names, expected)
+	}
+}
+
+func (m *mount_fixture) test_unlink(t *testing.T) {
+	folder, file := m.files["made"], m.files["made/inside.txt"]
+	if err := syscall.Rmdir(m.path("made")); err != syscall.ENOTEMPTY {
+		t.Errorf("Removing a folder with files inside gave %v instead of ENOTEMPTY", err)
+	}
+	if err := os.Remove(m.path("made/inside.txt")); err != nil {
+		t.Fatalf("Removing made/inside.txt failed: %v", err)
+	}
+	if err := syscall.Rmdir(m.path("made")); err != nil {
+		t.Fatalf("Removing made failed: %v", err)
+	}
+	entries := journal_entries(t)
+	if len(entries) != 2 || entries[0].Op != JournalOpRemove || entries[0].GoogleId != file.Id || entries[0].OldParent != folder.Id ||
+		entries[1].Op != JournalOpRemove || entries[1].GoogleId != folder.Id || entries[1].OldParent != "root" {
+		t.Fatalf("Got %+v instead of the removal of made/inside.txt and made", entries)
+	}
+	if _, err := os.Stat(m.path("made")); !os.IsNotExist(err) {
+		t.Errorf("Stat of made gave %v after removing it", err)
+	}
+
+	// Removed files go to the trash
+	m.replay(t)
+	for _, id := range []string{file.Id, folder.Id} {
+		if uploaded, _ := m.uploaded(t, id); !uploaded.Trashed {
+			t.Errorf("%s is not in the trash", id)
+		}
+	}
+	delete(m.files, "made")
+	delete(m.files, "made/inside.txt")
+	delete(m.contents, "made/inside.txt")
+	if names, expected := m.ls(t, "."), m.expected_ls("."); !same_strings(names, expected) {
+		t.Errorf("Got %q instead of %q", names, expected)
+	}
+}
+
+// Moving to another folder and renaming at once.
+func (m *mount_fixture) test_rename(t *testing.T) {
+	file, docs := m.files["hello.txt"], m.files["docs"]
+	content, err := ioutil.ReadFile(m.path("hello.txt"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Rename(m.path("hello.txt"), m.path("docs/greeting.txt")); err != nil {
+		t.Fatalf("Renaming hello.txt failed: %v", err)
+	}
+	entries := journal_entries(t)
+	if len(entries) != 1 || entries[0].Op != JournalOpRename || entries[0].GoogleId != file.Id || entries[0].Name != "greeting.txt" || entries[0].OldParent != "root" || entries[0].NewParent != docs.Id {
+		t.Fatalf("Got %+v instead of the move of hello.txt to docs/greeting.txt", entries)
+	}
+	if _, err := os.Stat(m.path("hello.txt")); !os.IsNotExist(err) {
+		t.Errorf("Stat of hello.txt gave %v after moving it", err)
+	}
+	if got, err := ioutil.ReadFile(m.path("docs/greeting.txt")); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Reading docs/greeting.txt returned %q, %v", got, err)
+	}
+
+	m.replay(t)
+	uploaded, _ := m.uploaded(t, file.Id)
+	if uploaded.Name != "greeting.txt" || len(uploaded.Parents) != 1 || uploaded.Parents[0] != docs.Id {
+		t.Errorf("Got %+v on the fake Drive", uploaded)
+	}
+	delete(m.files, "hello.txt")
+	delete(m.contents, "hello.txt")
+	m.files["docs/greeting.txt"] = uploaded
+	m.contents["docs/greeting.txt"] = content
+	for _, dir := range []string{".", "docs"} {
+		if names, expected := m.ls(t, dir), m.expected_ls(dir); !same_strings(names, expected) {
+			t.Errorf("Got %q instead of %q on %s", names, expected, dir)
+		}
+	}
+}
+
+func (m *mount_fixture) test_unmount(t *testing.T) {
+	StartUnmounting()
+	if err := FUSEServer.Unmount(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if names := m.ls(t, "."); len(names) != 0 {
+		t.Errorf("%s still has %q after unmounting", m.mount_point, names)
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -24,32 +29,58 @@ func escape(q string, args ...string) string {
 const NODE_GETBASICS_LOCAL_CACHE_ENABLE = false
 
 type MDNode struct {
-	GoogleId   string
-	inode      *nodefs.Inode
-	Name       string
-	MimeType   string
-	MD5        string
-	Size       uint64
-	Atime      uint64
-	Mtime      uint64
-	Ctime      uint64
-	Atimensec  uint32
-	Mtimensec  uint32
-	Ctimensec  uint32
-	GotBasics  bool
-	cache_file *os.File
-}
-
-func (n MDNode) SanitizedName() string {
+	GoogleId  string
+	inode     *nodefs.Inode
+	Name      string
+	MimeType  string
+	MD5       string
+	Size      uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	GotBasics bool
+	// Guards the fields above but GoogleId and inode, as GetBasics fills them in while other FUSE calls read them
+	mux sync.Mutex
+	// Children get the backend of their parent
+	backend DriveBackend
+}
+
+func (n *MDNode) SanitizedName() string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	return DriveSanitizeName(n.Name, n.MimeType)
 }
 
-func (n MDNode) UnambiguousName() string {
+func (n *MDNode) UnambiguousName() string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	return DriveUnambiguousName(n.GoogleId, n.Name, n.MimeType)
 }
 
 func (n *MDNode) IsDir() bool {
-	return n.MimeType == MimeTypeGoogleFolder
+	return n.mime_type() == MimeTypeGoogleFolder
+}
+
+func (n *MDNode) name() string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.Name
+}
+
+func (n *MDNode) mime_type() string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.MimeType
+}
+
+// Makes the next GetBasics load the basics again.
+func (n *MDNode) ExpireBasics() {
+	n.mux.Lock()
+	n.GotBasics = false
+	n.mux.Unlock()
 }
 
 func (fs *MDNode) OnUnmount() {
@@ -66,8 +97,9 @@ func (n *MDNode) StatFs() *fuse.StatfsOut {
 }
 
 func (n *MDNode) SetInode(node *nodefs.Inode) {
-	Log.DebugF("SetInode (%+v)", *node)
+	Log.DebugF("SetInode (%s)", n.GoogleId)
 	n.inode = node
+	node_register(n)
 }
 
 func (n *MDNode) Deletable() bool {
@@ -76,17 +108,24 @@ func (n *MDNode) Deletable() bool {
 }
 
 func (n *MDNode) Inode() *nodefs.Inode {
-	Log.DebugF("Inode (n=%v)", *n)
+	Log.DebugF("Inode (%s)", n.GoogleId)
 	return n.inode
 }
 
 func (n *MDNode) OnForget() {
 	Log.DebugF("OnForget")
-	if n.cache_file != nil {
-		if err := n.cache_file.Close(); err != nil {
-			Log.WarningF("Failed to close cache file for %s: %v", n.GoogleId, err)
-		}
+	node_unregister(n)
+}
+
+// Returns file, or any handle open for writing, unless it is read-only. Those have nothing the node does not know.
+func (n *MDNode) open_file(file nodefs.File) nodefs.File {
+	if _, read_only := file.(*MDReadFile); file != nil && !read_only {
+		return file
 	}
+	for _, f := range n.Inode().Files(fuse.O_ANYWRITE) {
+		return f.File
+	}
+	return nil
 }
 
 func (n *MDNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (ret_node *nodefs.Inode, ret_code fuse.Status) {
@@ -102,21 +141,24 @@ func (n *MDNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (ret
 		}
 	}()
 
-	Log.DebugF("Lookup (n=%v; out=%v; name=%v; context=%v)", *n, *out, name, *context)
+	Log.DebugF("Lookup (n=%s; out=%v; name=%v; context=%v)", n.GoogleId, *out, name, *context)
 	// Check for unmounting
-	if Unmounting {
+	if Unmounting() {
 		Log.DebugF("Lookup ENODEV (Unmounting)")
 		return nil, fuse.ENODEV
 	}
 
 	// Ensure data will be here
 	n.GetBasics()
-	DriveOpenDir(n.GoogleId)
+	dirs, status := DriveOpenDir(n.GoogleId)
+	if status == fuse.OK && len(dirs) == 0 {
+		return nil, fuse.ENOENT
+	}
 
 	// Check for cache
 	if CFoundPrefix("Lookup:"+name+":in:"+n.GoogleId+":", "id", "isDir") {
 		var isDir bool
-		new_node := &MDNode{}
+		new_node := &MDNode{backend: n.backend}
 		new_node.GoogleId = CGet_str("Lookup:" + name + ":in:" + n.GoogleId + ":id")
 		isDir = CGet_bool("Lookup:" + name + ":in:" + n.GoogleId + ":isDir")
 		child := n.Inode().NewChild(name, isDir, new_node)
@@ -142,26 +184,172 @@ func (n *MDNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Conte
 	Log.DebugF("Mknod")
 	return nil, fuse.ENOSYS
 }
-func (n *MDNode) Mkdir(name string, mode uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
-	Log.DebugF("Mkdir")
-	return nil, fuse.ENOSYS
+func (n *MDNode) Mkdir(name string, mode uint32, context *fuse.Context) (ret_node *nodefs.Inode, ret_code fuse.Status) {
+	_start := time.Now()
+	defer PrintCallDuration("Mkdir", &_start)
+
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_node = nil
+			ret_code = fuse.EIO
+		}
+	}()
+
+	Log.DebugF("Mkdir (n=%s; name=%v; mode=%v)", n.GoogleId, name, mode)
+	// Check for unmounting
+	if Unmounting() {
+		Log.DebugF("Mkdir ENODEV (Unmounting)")
+		return nil, fuse.ENODEV
+	}
+
+	google_id, code := DriveGenerateId(n.backend)
+	if code != fuse.OK {
+		return nil, code
+	}
+	new_node := &MDNode{backend: n.backend}
+	new_node.GoogleId = google_id
+	new_node.Name = DriveDesanitizeName(name)
+	new_node.MimeType = MimeTypeGoogleFolder
+
+	// Cache some stuff (a new folder is known to be empty)
+	now := time.Now().Format(time.RFC3339)
+	DriveGetBasicsPut(google_id, new_node.Name, new_node.MimeType, "", "", 0, now, now)
+	DriveOpenDirPut(google_id, []fuse.DirEntry{})
+	DriveOpenDirAdd(n.GoogleId, name, google_id, true)
+	JournalAppend(JournalEntry{Op: JournalOpMkdir, GoogleId: google_id, Name: new_node.Name, NewParent: n.GoogleId})
+
+	child := n.Inode().NewChild(name, true, new_node)
+	Log.DebugF("Mkdir %s -> %s", name, google_id)
+	return child, fuse.OK
 }
 func (n *MDNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	Log.DebugF("Unlink")
-	return fuse.ENOSYS
+	_start := time.Now()
+	defer PrintCallDuration("Unlink", &_start)
+
+	Log.DebugF("Unlink (n=%s; name=%v)", n.GoogleId, name)
+	return n.removeChild(name, false)
 }
+
 func (n *MDNode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	Log.DebugF("Rmdir")
-	return fuse.ENOSYS
+	_start := time.Now()
+	defer PrintCallDuration("Rmdir", &_start)
+
+	Log.DebugF("Rmdir (n=%s; name=%v)", n.GoogleId, name)
+	return n.removeChild(name, true)
+}
+
+// Trashes (or deletes) the child called name. isDir tells whether we are doing a Rmdir or an Unlink.
+func (n *MDNode) removeChild(name string, isDir bool) (ret_code fuse.Status) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_code = fuse.EIO
+		}
+	}()
+
+	// Check for unmounting
+	if Unmounting() {
+		return fuse.ENODEV
+	}
+
+	// Ensure data will be here
+	DriveOpenDir(n.GoogleId)
+	if !CFoundPrefix("Lookup:"+name+":in:"+n.GoogleId+":", "id", "isDir") {
+		return fuse.ENOENT
+	}
+	child_id := CGet_str("Lookup:" + name + ":in:" + n.GoogleId + ":id")
+	child_is_dir := CGet_bool("Lookup:" + name + ":in:" + n.GoogleId + ":isDir")
+	if isDir && !child_is_dir {
+		return fuse.ENOTDIR
+	}
+	if !isDir && child_is_dir {
+		return fuse.EISDIR
+	}
+	if isDir {
+		dirs, status := DriveOpenDir(child_id)
+		if status == fuse.OK && len(dirs) > 0 {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+	}
+
+	DriveForget(child_id)
+	DriveOpenDirRemove(n.GoogleId, name)
+	JournalAppend(JournalEntry{Op: JournalOpRemove, GoogleId: child_id, OldParent: n.GoogleId})
+	n.Inode().RmChild(name)
+	Log.DebugF("Removed %s (%s) from %s", name, child_id, n.GoogleId)
+	return fuse.OK
 }
 func (n *MDNode) Symlink(name string, content string, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
 	Log.DebugF("Symlink")
 	return nil, fuse.ENOSYS
 }
 
-func (n *MDNode) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) (code fuse.Status) {
-	Log.DebugF("Rename")
-	return fuse.ENOSYS
+func (n *MDNode) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) (ret_code fuse.Status) {
+	_start := time.Now()
+	defer PrintCallDuration("Rename", &_start)
+
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_code = fuse.EIO
+		}
+	}()
+
+	Log.DebugF("Rename (n=%s; oldName=%v; newName=%v)", n.GoogleId, oldName, newName)
+	// Check for unmounting
+	if Unmounting() {
+		Log.DebugF("Rename ENODEV (Unmounting)")
+		return fuse.ENODEV
+	}
+	new_parent, ok := newParent.(*MDNode)
+	if !ok {
+		return fuse.EXDEV
+	}
+
+	// Find what we are moving
+	DriveOpenDir(n.GoogleId)
+	if !CFoundPrefix("Lookup:"+oldName+":in:"+n.GoogleId+":", "id", "isDir") {
+		return fuse.ENOENT
+	}
+	google_id := CGet_str("Lookup:" + oldName + ":in:" + n.GoogleId + ":id")
+	isDir := CGet_bool("Lookup:" + oldName + ":in:" + n.GoogleId + ":isDir")
+	if code := DriveGetBasics(google_id); code != fuse.OK {
+		return code
+	}
+	rec, _ := BasicsGet(google_id)
+	name := DriveNameFromSanitized(newName, rec.MimeType)
+	// Exported files keep the extension of the format they are exported as, whatever they were renamed to
+	newName = DriveSanitizeName(name, rec.MimeType)
+
+	// Replace the target like POSIX does
+	DriveOpenDir(new_parent.GoogleId)
+	if CFoundPrefix("Lookup:"+newName+":in:"+new_parent.GoogleId+":", "id", "isDir") {
+		target_id := CGet_str("Lookup:" + newName + ":in:" + new_parent.GoogleId + ":id")
+		if target_id == google_id {
+			return fuse.OK
+		}
+		if code := new_parent.removeChild(newName, isDir); code != fuse.OK {
+			return code
+		}
+	}
+
+	// Rename it
+	BasicsUpdate(google_id, func(rec *BasicsRecord) { rec.Name = name })
+	DriveOpenDirMove(n.GoogleId, oldName, new_parent.GoogleId, newName, google_id, isDir)
+	JournalAppend(JournalEntry{Op: JournalOpRename, GoogleId: google_id, Name: name, OldParent: n.GoogleId, NewParent: new_parent.GoogleId})
+
+	// Keep the kernel's view in sync
+	ch := n.Inode().RmChild(oldName)
+	new_parent.Inode().RmChild(newName)
+	if ch != nil {
+		new_parent.Inode().AddChild(newName, ch)
+	}
+	Log.DebugF("Renamed %s (%s) to %s in %s", oldName, google_id, newName, new_parent.GoogleId)
+	return fuse.OK
 }
 
 func (n *MDNode) Link(name string, existing nodefs.Node, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
@@ -169,14 +357,111 @@ func (n *MDNode) Link(name string, existing nodefs.Node, context *fuse.Context)
 	return nil, fuse.ENOSYS
 }
 
-func (n *MDNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, newNode *nodefs.Inode, code fuse.Status) {
-	Log.DebugF("Create")
-	return nil, nil, fuse.ENOSYS
+func (n *MDNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (ret_file nodefs.File, ret_node *nodefs.Inode, ret_code fuse.Status) {
+	_start := time.Now()
+	defer PrintCallDuration("Create", &_start)
+
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_file = nil
+			ret_node = nil
+			ret_code = fuse.EIO
+		}
+	}()
+
+	Log.DebugF("Create (n=%s; name=%v; flags=%v; mode=%v)", n.GoogleId, name, flags, mode)
+	// Check for unmounting
+	if Unmounting() {
+		Log.DebugF("Create ENODEV (Unmounting)")
+		return nil, nil, fuse.ENODEV
+	}
+
+	// Get an id so the file can be found before it is uploaded
+	google_id, code := DriveGenerateId(n.backend)
+	if code != fuse.OK {
+		return nil, nil, code
+	}
+	new_node := &MDNode{backend: n.backend}
+	new_node.GoogleId = google_id
+	new_node.Name = DriveDesanitizeName(name)
+	new_node.MimeType, _, _ = mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+
+	// Stage file
+	f, err := os.OpenFile(CacheDir+google_id, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		Log.ErrorF("Unable to Create %s: %v", name, err)
+		return nil, nil, fuse.EIO
+	}
+
+	// Cache some stuff
+	now := time.Now().Format(time.RFC3339)
+	DriveGetBasicsPut(google_id, new_node.Name, new_node.MimeType, "", "", 0, now, now)
+	DriveOpenDirAdd(n.GoogleId, name, google_id, false)
+
+	child := n.Inode().NewChild(name, false, new_node)
+	Log.DebugF("Create %s -> %s", name, google_id)
+	md_file := NewMDFile(new_node, n.GoogleId, f, false)
+	// An empty file must be created on Google Drive too
+	md_file.dirty = true
+	return md_file, child, fuse.OK
 }
 
-func (n *MDNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	Log.DebugF("Open")
-	return nil, fuse.OK
+func (n *MDNode) Open(flags uint32, context *fuse.Context) (ret_file nodefs.File, ret_code fuse.Status) {
+	_start := time.Now()
+	defer PrintCallDuration("Open", &_start)
+
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+			ret_file = nil
+			ret_code = fuse.EIO
+		}
+	}()
+
+	Log.DebugF("Open (n=%s; flags=%v)", n.GoogleId, flags)
+	// Check for unmounting
+	if Unmounting() {
+		Log.DebugF("Open ENODEV (Unmounting)")
+		return nil, fuse.ENODEV
+	}
+	if err := n.GetBasics(); err != fuse.OK {
+		return nil, err
+	}
+	// Read only opens are served straight from the cache
+	if flags&fuse.O_ANYWRITE == 0 {
+		// The size of exported files is only known after they are downloaded, so do not let the kernel trust it
+		if _, export := DriveExportMimeType(n.mime_type()); export {
+			return &nodefs.WithFlags{File: NewMDReadFile(n), FuseFlags: fuse.FOPEN_DIRECT_IO}, fuse.OK
+		}
+		return NewMDReadFile(n), fuse.OK
+	}
+
+	// Google Docs and friends have no content we could upload
+	if strings.HasPrefix(n.mime_type(), "application/vnd.google-apps.") {
+		return nil, fuse.EPERM
+	}
+
+	// Ensure we have a local copy to edit
+	trunc := flags&syscall.O_TRUNC != 0
+	open_flags := os.O_RDWR
+	if trunc {
+		open_flags |= os.O_CREATE | os.O_TRUNC
+	} else if sts := DriveRead(n.GoogleId); sts != fuse.OK {
+		Log.ErrorF("Unable to Open %s: %v", n.GoogleId, sts)
+		return nil, sts
+	}
+	f, err := os.OpenFile(CacheDir+n.GoogleId, open_flags, 0644)
+	if err != nil {
+		Log.ErrorF("Unable to Open %s: %v", n.GoogleId, err)
+		return nil, fuse.EIO
+	}
+	md_file := NewMDFile(n, "", f, true)
+	// A truncated file must be uploaded even if nothing is written
+	md_file.dirty = trunc
+	return md_file, fuse.OK
 }
 
 func (n *MDNode) Flush(file nodefs.File, openFlags uint32, context *fuse.Context) (code fuse.Status) {
@@ -199,7 +484,7 @@ func (n *MDNode) OpenDir(context *fuse.Context) (ret_dirs []fuse.DirEntry, ret_c
 
 	Log.DebugF("OpenDir (n=%s, context=%v)", n.GoogleId, *context)
 	// Check for unmounting
-	if Unmounting {
+	if Unmounting() {
 		Log.DebugF("OpenDir ENODEV (Unmounting)")
 		return nil, fuse.ENODEV
 	}
@@ -215,31 +500,82 @@ func (n *MDNode) GetXAttr(attribute string, context *fuse.Context) (data []byte,
 		return []byte(n.GoogleId), fuse.OK
 	}
 	if attribute == "user.mime" {
-		return []byte(n.MimeType), fuse.OK
+		return []byte(n.mime_type()), fuse.OK
+	}
+	if attribute == PIN_XATTR && PinIsPinned(n.GoogleId) {
+		return []byte("1"), fuse.OK
+	}
+	if attribute == "user.megadrive.conflict" && CFound("Conflict:"+n.GoogleId) {
+		return []byte(CGet_str("Conflict:" + n.GoogleId)), fuse.OK
 	}
 	return nil, fuse.ENOATTR
 }
 
 func (n *MDNode) RemoveXAttr(attr string, context *fuse.Context) fuse.Status {
-	Log.DebugF("RemoveXAttr")
+	Log.DebugF("RemoveXAttr (attr=%v)", attr)
+	// Removing the conflict mark means the user has dealt with it
+	if attr == "user.megadrive.conflict" {
+		if !CFound("Conflict:" + n.GoogleId) {
+			return fuse.ENOATTR
+		}
+		CDel("Conflict:" + n.GoogleId)
+		return fuse.OK
+	}
+	if attr == PIN_XATTR {
+		if !PinIsPinned(n.GoogleId) {
+			return fuse.ENOATTR
+		}
+		PinSet(n.GoogleId, false)
+		return fuse.OK
+	}
 	return fuse.ENOSYS
 }
 
 func (n *MDNode) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	Log.DebugF("SetXAttr")
+	Log.DebugF("SetXAttr (attr=%v; data=%s)", attr, data)
+	if attr == PIN_XATTR {
+		pinned, err := strconv.ParseBool(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fuse.EINVAL
+		}
+		PinSet(n.GoogleId, pinned)
+		return fuse.OK
+	}
+	if attr == GC_XATTR {
+		GcRequest()
+		return fuse.OK
+	}
+	if attr == VERIFY_XATTR {
+		if n.IsDir() {
+			go CacheVerifyTree(n.GoogleId)
+		} else {
+			CacheVerify(n.GoogleId)
+		}
+		return fuse.OK
+	}
 	return fuse.ENOSYS
 }
 
 func (n *MDNode) ListXAttr(context *fuse.Context) (attrs []string, code fuse.Status) {
 	Log.DebugF("ListXAttr")
-	return []string{"user.google-id", "user.mime"}, fuse.OK
+	attrs = []string{"user.google-id", "user.mime"}
+	if PinIsPinned(n.GoogleId) {
+		attrs = append(attrs, PIN_XATTR)
+	}
+	if CFound("Conflict:" + n.GoogleId) {
+		attrs = append(attrs, "user.megadrive.conflict")
+	}
+	return attrs, fuse.OK
 }
 
 func (n *MDNode) GetBasics() fuse.Status {
 	_start := time.Now()
 	defer PrintCallDuration("GetBasics", &_start)
 
-	if n.GotBasics && NODE_GETBASICS_LOCAL_CACHE_ENABLE {
+	n.mux.Lock()
+	got_basics := n.GotBasics
+	n.mux.Unlock()
+	if got_basics && NODE_GETBASICS_LOCAL_CACHE_ENABLE {
 		return fuse.OK
 	}
 
@@ -247,18 +583,19 @@ func (n *MDNode) GetBasics() fuse.Status {
 	if err != fuse.OK {
 		return err
 	}
-	CRLock("BasicAttr:" + n.GoogleId + "!mux")
-	defer CRUnlock("BasicAttr:" + n.GoogleId + "!mux")
-	n.Name = CGet_str("BasicAttr:" + n.GoogleId + ":Name")
-	n.MimeType = CGet_str("BasicAttr:" + n.GoogleId + ":MimeType")
-	n.MD5 = CGet_str("BasicAttr:" + n.GoogleId + ":MD5")
-	n.Size = CGetDef_uint64("BasicAttr:"+n.GoogleId+":Size", 0)
-	n.Atime = CGetDef_uint64("BasicAttr:"+n.GoogleId+":Atime", 0)
-	n.Ctime = CGetDef_uint64("BasicAttr:"+n.GoogleId+":Ctime", 0)
-	n.Mtime = CGetDef_uint64("BasicAttr:"+n.GoogleId+":Mtime", 0)
-	n.Atimensec = CGetDef_uint32("BasicAttr:"+n.GoogleId+":Atimensec", 0)
-	n.Ctimensec = CGetDef_uint32("BasicAttr:"+n.GoogleId+":Ctimensec", 0)
-	n.Mtimensec = CGetDef_uint32("BasicAttr:"+n.GoogleId+":Mtimensec", 0)
+	rec, _ := BasicsGet(n.GoogleId)
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.Name = rec.Name
+	n.MimeType = rec.MimeType
+	n.MD5 = rec.MD5
+	n.Size = rec.Size
+	n.Atime = rec.Atime
+	n.Ctime = rec.Ctime
+	n.Mtime = rec.Mtime
+	n.Atimensec = rec.Atimensec
+	n.Ctimensec = rec.Ctimensec
+	n.Mtimensec = rec.Mtimensec
 
 	n.GotBasics = true
 	return fuse.OK
@@ -276,13 +613,14 @@ func (n *MDNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context
 		}
 	}()
 
-	Log.DebugF("GetAttr (n=%v; out=%v; file=%v; context=%v)", *n, *out, file, *context)
+	Log.DebugF("GetAttr (n=%s; out=%v; file=%v; context=%v)", n.GoogleId, *out, file, *context)
 	// Check for unmounting
-	if Unmounting {
+	if Unmounting() {
 		Log.DebugF("Lookup GetAttr (Unmounting)")
 		return fuse.ENODEV
 	}
-	if file != nil {
+	// Prefer an open file as it may have unsaved writes
+	if file = n.open_file(file); file != nil {
 		return file.GetAttr(out)
 	}
 	// Basics first
@@ -302,6 +640,7 @@ func (n *MDNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context
 		DriveOpenDirPreload(n.GoogleId)
 	}
 
+	n.mux.Lock()
 	out.Size = n.Size
 	out.Atime = n.Atime
 	out.Ctime = n.Ctime
@@ -309,8 +648,10 @@ func (n *MDNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context
 	out.Atimensec = n.Atimensec
 	out.Ctimensec = n.Ctimensec
 	out.Mtimensec = n.Mtimensec
+	mime_type := n.MimeType
+	n.mux.Unlock()
 
-	Log.DebugF("GetAttr %s -> ctime=%d mtime=%d mime=%s size=%d", n.GoogleId, out.Ctime, out.Mtime, n.MimeType, out.Size)
+	Log.DebugF("GetAttr %s -> ctime=%d mtime=%d mime=%s size=%d", n.GoogleId, out.Ctime, out.Mtime, mime_type, out.Size)
 	return fuse.OK
 }
 
@@ -326,7 +667,41 @@ func (n *MDNode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.C
 
 func (n *MDNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (code fuse.Status) {
 	Log.DebugF("Truncate")
-	return fuse.ENOSYS
+	// Check for unmounting
+	if Unmounting() {
+		return fuse.ENODEV
+	}
+	if file = n.open_file(file); file != nil {
+		return file.Truncate(size)
+	}
+
+	// Truncate the local copy and queue it for upload
+	if err := n.GetBasics(); err != fuse.OK {
+		return err
+	}
+	if strings.HasPrefix(n.mime_type(), "application/vnd.google-apps.") {
+		return fuse.EPERM
+	}
+	if size > 0 {
+		if sts := DriveRead(n.GoogleId); sts != fuse.OK {
+			Log.ErrorF("Unable to Truncate %s: %v", n.GoogleId, sts)
+			return sts
+		}
+	}
+	f, err := os.OpenFile(CacheDir+n.GoogleId, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		Log.ErrorF("Unable to Truncate %s: %v", n.GoogleId, err)
+		return fuse.EIO
+	}
+	err = f.Truncate(int64(size))
+	f.Close()
+	if err != nil {
+		Log.ErrorF("Unable to Truncate %s: %v", n.GoogleId, err)
+		return fuse.EIO
+	}
+	JournalAppend(JournalEntry{Op: JournalOpUpdate, GoogleId: n.GoogleId})
+	BasicsUpdateLocal(n.GoogleId)
+	return fuse.OK
 }
 
 func (n *MDNode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
@@ -342,7 +717,6 @@ func (n *MDNode) Fallocate(file nodefs.File, off uint64, size uint64, mode uint3
 func (n *MDNode) Read(file nodefs.File, dest []byte, off int64, context *fuse.Context) (ret_res fuse.ReadResult, ret_code fuse.Status) {
 	_start := time.Now()
 	defer PrintCallDuration("Read", &_start)
-	var err error
 
 	// Save ourselves
 	defer func() {
@@ -354,28 +728,28 @@ func (n *MDNode) Read(file nodefs.File, dest []byte, off int64, context *fuse.Co
 	}()
 
 	Log.DebugF("Read (len(dest)=%v off=%v context=%v", len(dest), off, context)
-	sts := DriveRead(n.GoogleId)
-	if sts != fuse.OK {
-		Log.ErrorF("Unable to Read %s: %v", n.GoogleId, sts)
-		return nil, sts
+	// Prefer an open file as it may have unsaved writes
+	if file == nil {
+		file = n.open_file(nil)
 	}
-	if n.cache_file != nil {
-		if err := n.cache_file.Close(); err != nil {
-			Log.WarningF("Unable to Read %s: failed to close previous file: %v", n.GoogleId, err)
-		}
+	if file != nil {
+		return file.Read(dest, off)
 	}
-	n.cache_file, err = os.Open(CacheDir + n.GoogleId)
-	if err != nil {
-		Log.ErrorF("Unable to Read %s: %v", n.GoogleId, err)
-		return nil, fuse.EIO
+	// Without a handle, copy the bytes out before the file is closed
+	rf := NewMDReadFile(n)
+	defer rf.Release()
+	res, sts := rf.Read(dest, off)
+	if sts != fuse.OK {
+		return nil, sts
 	}
-	return fuse.ReadResultFd(n.cache_file.Fd(), off, len(dest)), fuse.OK
+	byt, sts := res.Bytes(dest)
+	return fuse.ReadResultData(byt), sts
 }
 
 func (n *MDNode) Write(file nodefs.File, data []byte, off int64, context *fuse.Context) (written uint32, code fuse.Status) {
 	Log.DebugF("Write")
 	// Check for unmounting
-	if Unmounting {
+	if Unmounting() {
 		return 0, fuse.ENODEV
 	}
 	if file != nil {
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Changes found on Google Drive are told to the kernel so it drops what it cached about them. They go through NotifyConsumer because the kernel must not be notified while it waits for an answer about the same inode.
+type notify_req struct {
+	kind      int
+	google_id string
+	name      string
+}
+
+const (
+	notify_file = iota
+	notify_entry
+	notify_delete
+)
+
+// Requests waiting for NotifyConsumer. There is no limit, as the callers may hold locks the kernel is waiting on and must never block. A request that is already waiting is not queued again.
+var NotifyQueue = make([]notify_req, 0)
+var NotifyQueued = make(map[notify_req]bool)
+var NotifyQueueMux = new(sync.Mutex)
+var ChNotify = make(chan bool, 1)
+
+// Every MDNode the kernel knows about, by file id. A file may have more than one.
+var MapIdNodes = make(map[string]map[*MDNode]bool)
+var MapIdNodesMux = new(sync.Mutex)
+
+func node_register(n *MDNode) {
+	MapIdNodesMux.Lock()
+	defer MapIdNodesMux.Unlock()
+	if _, ok := MapIdNodes[n.GoogleId]; !ok {
+		MapIdNodes[n.GoogleId] = make(map[*MDNode]bool)
+	}
+	MapIdNodes[n.GoogleId][n] = true
+}
+
+func node_unregister(n *MDNode) {
+	MapIdNodesMux.Lock()
+	defer MapIdNodesMux.Unlock()
+	delete(MapIdNodes[n.GoogleId], n)
+	if len(MapIdNodes[n.GoogleId]) == 0 {
+		delete(MapIdNodes, n.GoogleId)
+	}
+}
+
+func nodes_of(google_id string) []*MDNode {
+	MapIdNodesMux.Lock()
+	defer MapIdNodesMux.Unlock()
+	nodes := make([]*MDNode, 0, len(MapIdNodes[google_id]))
+	for n := range MapIdNodes[google_id] {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func notify_push(req notify_req) {
+	NotifyQueueMux.Lock()
+	if !NotifyQueued[req] {
+		NotifyQueued[req] = true
+		NotifyQueue = append(NotifyQueue, req)
+	}
+	NotifyQueueMux.Unlock()
+	// Wake up NotifyConsumer
+	select {
+	case ChNotify <- true:
+	default:
+	}
+}
+
+// Takes every request queued so far.
+func notify_take() []notify_req {
+	NotifyQueueMux.Lock()
+	defer NotifyQueueMux.Unlock()
+	reqs := NotifyQueue
+	NotifyQueue = make([]notify_req, 0)
+	NotifyQueued = make(map[notify_req]bool)
+	return reqs
+}
+
+// Tells the kernel the content and attributes of google_id changed.
+func NotifyFile(google_id string) {
+	notify_push(notify_req{notify_file, google_id, ""})
+}
+
+// Tells the kernel name may now exist inside parent_id.
+func NotifyEntry(parent_id, name string) {
+	notify_push(notify_req{notify_entry, parent_id, name})
+}
+
+// Tells the kernel name no longer exists inside parent_id.
+func NotifyDelete(parent_id, name string) {
+	notify_push(notify_req{notify_delete, parent_id, name})
+}
+
+func NotifyConsumer() {
+	Log.Notice("NotifyConsumer: Started")
+	for range ChNotify {
+		for _, req := range notify_take() {
+			if FSConn == nil || Unmounting() {
+				continue
+			}
+			for _, n := range nodes_of(req.google_id) {
+				NotifyConsumerCore(n, req)
+			}
+		}
+	}
+}
+
+func NotifyConsumerCore(n *MDNode, req notify_req) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+		}
+	}()
+
+	inode := n.Inode()
+	if inode == nil {
+		return
+	}
+	var sts fuse.Status
+	switch req.kind {
+	case notify_file:
+		n.ExpireBasics()
+		sts = FSConn.FileNotify(inode, 0, 0)
+	case notify_entry:
+		sts = FSConn.EntryNotify(inode, req.name)
+	case notify_delete:
+		if child := inode.GetChild(req.name); child != nil {
+			sts = FSConn.DeleteNotify(inode, child, req.name)
+			inode.RmChild(req.name)
+		} else {
+			sts = FSConn.EntryNotify(inode, req.name)
+		}
+	}
+	// Old kernels do not know some notifications and the kernel may not know the inode anymore
+	if sts != fuse.OK && sts != fuse.ENOENT && sts != fuse.ENOSYS {
+		Log.WarningF("NotifyConsumerCore: Failed to notify the kernel about %s (%s): %v", req.google_id, req.name, sts)
+	}
+}
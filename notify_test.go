@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Notifications are sent while locks the kernel may wait on are held, so queueing them must never block, even if NotifyConsumer is stuck.
+func TestNotifyNeverBlocks(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			NotifyFile("file" + strconv.Itoa(i))
+			NotifyEntry("root", "name"+strconv.Itoa(i))
+			NotifyDelete("root", "name"+strconv.Itoa(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Queueing notifications blocked")
+	}
+	notify_take()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const PIN_REFRESH_DELTA = 5 * time.Minute
+const PIN_XATTR = "user.megadrive.pinned"
+
+// Pinned files and folders are listed as "Pin:<id>" keys. PinConsumer walks them (recursively for folders) keeping a fresh copy of everything on CacheDir and marks every file it keeps with "PinKeep:<id>" so other parts of MegaDrive know they should not be thrown away.
+var ChPin = make(chan bool, 1)
+
+func PinSet(google_id string, pinned bool) {
+	if pinned {
+		CSet("Pin:"+google_id, true)
+		Log.InfoF("Pinned %s", google_id)
+	} else {
+		CDel("Pin:" + google_id)
+		Log.InfoF("Unpinned %s", google_id)
+	}
+	// Wake up PinConsumer
+	select {
+	case ChPin <- true:
+	default:
+	}
+}
+
+// Tells whether google_id itself was pinned.
+func PinIsPinned(google_id string) bool {
+	return CFound("Pin:" + google_id)
+}
+
+// Tells whether google_id was pinned or is inside a pinned folder.
+func PinIsKept(google_id string) bool {
+	return PinIsPinned(google_id) || CFound("PinKeep:"+google_id)
+}
+
+func PinList() []string {
+	keys := CKeysPrefix("Pin:")
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = strings.TrimPrefix(key, "Pin:")
+	}
+	return ids
+}
+
+func PinConsumer() {
+	Log.Notice("PinConsumer: Started")
+	for !Unmounting() {
+		_start := time.Now()
+		PinRefresh(_start.Unix())
+		PrintCallDuration("PinConsumer", &_start)
+
+		select {
+		case <-ChPin:
+		case <-time.After(PIN_REFRESH_DELTA):
+		}
+	}
+}
+
+// Walks every pin once, marking what it keeps with round, which must grow from one call to the next.
+func PinRefresh(round int64) {
+	seen := make(map[string]bool)
+	for _, google_id := range PinList() {
+		PinWalk(google_id, round, seen)
+	}
+	// Forget files that are no longer inside a pinned folder
+	for _, key := range CKeysPrefix("PinKeep:") {
+		if CGetDef_int64(key, 0) < round {
+			CDel(key)
+		}
+	}
+}
+
+// Ensures google_id (and everything inside it) is on CacheDir and up to date.
+func PinWalk(google_id string, round int64, seen map[string]bool) {
+	// Save ourselves
+	defer func() {
+		if r := recover(); r != nil {
+			Log.ErrorF("Recovered: %+v", r)
+		}
+	}()
+
+	if seen[google_id] || Unmounting() {
+		return
+	}
+	seen[google_id] = true
+	CSet("PinKeep:"+google_id, round)
+
+	if sts := DriveGetBasics(google_id); sts != fuse.OK {
+		Log.WarningF("PinWalk: Unable to get basics for %s: %v", google_id, sts)
+		return
+	}
+	if rec, _ := BasicsGet(google_id); !rec.IsDir() {
+		if sts := DriveRead(google_id); sts != fuse.OK {
+			Log.WarningF("PinWalk: Unable to read %s: %v", google_id, sts)
+		}
+		return
+	}
+	dirs, sts := DriveOpenDir(google_id)
+	if sts != fuse.OK {
+		Log.WarningF("PinWalk: Unable to open %s: %v", google_id, sts)
+		return
+	}
+	for _, entry := range dirs {
+		child_id := CGet_str("Lookup:" + entry.Name + ":in:" + google_id + ":id")
+		if child_id != "" {
+			PinWalk(child_id, round, seen)
+		}
+	}
+}
+
+// Implements "MegaDrive pin PATH..." and "MegaDrive unpin PATH...". It works on an already mounted MegaDrive by setting the pin extended attribute.
+func PinCommand(cmd string, paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage:\n  MegaDrive %s PATH...\n", cmd)
+		return 2
+	}
+	ret := 0
+	for _, path := range paths {
+		var err error
+		if cmd == "pin" {
+			err = syscall.Setxattr(path, PIN_XATTR, []byte("1"), 0)
+		} else {
+			err = syscall.Removexattr(path, PIN_XATTR)
+			if err == syscall.ENODATA {
+				err = nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to %s %s: %v\n", cmd, path, err)
+			ret = 1
+		}
+	}
+	return ret
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func pin_cached(google_id string, content []byte) bool {
+	got, err := ioutil.ReadFile(CacheDir + google_id)
+	return err == nil && bytes.Equal(got, content) && CFound("Read:"+google_id+":!ret")
+}
+
+func TestPinRefresh(t *testing.T) {
+	b := fake_drive_env(t)
+	test_consumers(b)
+	album := b.Put("root", "album", MimeTypeGoogleFolder, nil)
+	more := b.Put(album.Id, "more", MimeTypeGoogleFolder, nil)
+	photo1 := b.Put(album.Id, "photo1.jpg", "image/jpeg", []byte("first"))
+	photo2 := b.Put(more.Id, "photo2.jpg", "image/jpeg", []byte("second"))
+	loose := b.Put("root", "loose.txt", "text/plain", []byte("loose"))
+
+	// Everything inside a pinned folder is downloaded and kept
+	PinSet(album.Id, true)
+	PinRefresh(1)
+	if !pin_cached(photo1.Id, []byte("first")) || !pin_cached(photo2.Id, []byte("second")) {
+		t.Fatalf("The files inside album were not downloaded")
+	}
+	if !PinIsKept(photo2.Id) || !PinIsKept(more.Id) || !PinIsPinned(album.Id) || PinIsPinned(photo1.Id) {
+		t.Errorf("Only album should be pinned and only what is inside it kept")
+	}
+	if PinIsKept(loose.Id) || pin_cached(loose.Id, []byte("loose")) {
+		t.Errorf("loose.txt is kept although it is not inside album")
+	}
+
+	// Files pinned by themselves
+	PinSet(loose.Id, true)
+	PinRefresh(2)
+	if !pin_cached(loose.Id, []byte("loose")) || !PinIsKept(loose.Id) {
+		t.Errorf("loose.txt was not downloaded after pinning it")
+	}
+	if list := PinList(); !same_strings(list, []string{album.Id, loose.Id}) {
+		t.Errorf("PinList returned %v", list)
+	}
+
+	// Unpinning lets go of everything inside
+	PinSet(album.Id, false)
+	PinRefresh(3)
+	if PinIsKept(photo1.Id) || PinIsKept(photo2.Id) || PinIsKept(more.Id) || PinIsPinned(album.Id) {
+		t.Errorf("The files inside album are still kept after unpinning it")
+	}
+	if !PinIsKept(loose.Id) {
+		t.Errorf("loose.txt is no longer kept")
+	}
+}
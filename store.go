@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Everything MegaDrive remembers goes through a MetadataStore, which is a set of named buckets of ordered keys. The functions on cache.go and journal.go only talk to Store, never to a specific database.
+type MetadataStore interface {
+	// Runs fn inside a read-only transaction.
+	View(fn func(tx StoreTx) error) error
+	// Runs fn inside a read-write transaction. Nothing is saved if fn returns an error.
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+type StoreTx interface {
+	// Returns nil if key is not on bucket. The returned slice is only valid during the transaction.
+	Get(bucket, key []byte) []byte
+	Put(bucket, key, val []byte) error
+	Delete(bucket, key []byte) error
+	// Calls fn for every key of bucket starting with prefix, in order. If fn returns ErrStoreStop, ForEach stops and returns nil. fn must not change bucket (bolt's cursors skip keys then), so collect the keys first.
+	ForEach(bucket, prefix []byte, fn func(key, val []byte) error) error
+	// Returns a number that was never returned before for this bucket.
+	NextSequence(bucket []byte) (uint64, error)
+}
+
+var ErrStoreStop = errors.New("stop")
+var ErrStoreReadOnly = errors.New("read-only transaction")
+
+var Store MetadataStore
+
+// Every bucket MegaDrive uses. They are created when a store is opened.
+var StoreBuckets = [][]byte{StdBucket, JournalBucket, JournalDeadBucket}
+
+// Opens the store named kind ("bolt", "sqlite" or "memory") at CacheDir.
+func OpenStore(kind string) (MetadataStore, error) {
+	switch kind {
+	case "bolt":
+		return NewBoltStore(CacheDir + "bolt.db")
+	case "sqlite":
+		return NewSQLiteStore(CacheDir + "cache.sqlite")
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store %q (use bolt, sqlite or memory)", kind)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Keeps everything in memory, so nothing survives a restart. Meant for tests and for trying MegaDrive out.
+type MemoryStore struct {
+	buckets   map[string]map[string][]byte
+	sequences map[string]uint64
+	mux       *sync.RWMutex
+}
+
+// Writes are kept aside until the transaction is over, so a failed Update changes nothing. A nil value means the key was deleted.
+type memory_tx struct {
+	store     *MemoryStore
+	writable  bool
+	changes   map[string]map[string][]byte
+	sequences map[string]uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		buckets:   make(map[string]map[string][]byte),
+		sequences: make(map[string]uint64),
+		mux:       new(sync.RWMutex),
+	}
+	for _, bucket := range StoreBuckets {
+		s.buckets[string(bucket)] = make(map[string][]byte)
+	}
+	return s
+}
+
+func (s *MemoryStore) View(fn func(tx StoreTx) error) error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return fn(&memory_tx{store: s})
+}
+
+func (s *MemoryStore) Update(fn func(tx StoreTx) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	tx := &memory_tx{
+		store:     s,
+		writable:  true,
+		changes:   make(map[string]map[string][]byte),
+		sequences: make(map[string]uint64),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// Commit
+	for bucket, changes := range tx.changes {
+		if s.buckets[bucket] == nil {
+			s.buckets[bucket] = make(map[string][]byte)
+		}
+		for key, val := range changes {
+			if val == nil {
+				delete(s.buckets[bucket], key)
+			} else {
+				s.buckets[bucket][key] = val
+			}
+		}
+	}
+	for bucket, seq := range tx.sequences {
+		s.sequences[bucket] = seq
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (t *memory_tx) Get(bucket, key []byte) []byte {
+	if val, ok := t.changes[string(bucket)][string(key)]; ok {
+		return val
+	}
+	return t.store.buckets[string(bucket)][string(key)]
+}
+
+func (t *memory_tx) Put(bucket, key, val []byte) error {
+	if !t.writable {
+		return ErrStoreReadOnly
+	}
+	if t.changes[string(bucket)] == nil {
+		t.changes[string(bucket)] = make(map[string][]byte)
+	}
+	// Callers may reuse val once Put returns
+	t.changes[string(bucket)][string(key)] = append([]byte{}, val...)
+	return nil
+}
+
+func (t *memory_tx) Delete(bucket, key []byte) error {
+	if !t.writable {
+		return ErrStoreReadOnly
+	}
+	if t.changes[string(bucket)] == nil {
+		t.changes[string(bucket)] = make(map[string][]byte)
+	}
+	t.changes[string(bucket)][string(key)] = nil
+	return nil
+}
+
+func (t *memory_tx) ForEach(bucket, prefix []byte, fn func(key, val []byte) error) error {
+	p := string(prefix)
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for key := range t.store.buckets[string(bucket)] {
+		if strings.HasPrefix(key, p) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for key := range t.changes[string(bucket)] {
+		if strings.HasPrefix(key, p) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		val := t.Get(bucket, []byte(key))
+		if val == nil {
+			continue
+		}
+		if err := fn([]byte(key), val); err == ErrStoreStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memory_tx) NextSequence(bucket []byte) (uint64, error) {
+	if !t.writable {
+		return 0, ErrStoreReadOnly
+	}
+	seq, ok := t.sequences[string(bucket)]
+	if !ok {
+		seq = t.store.sequences[string(bucket)]
+	}
+	seq++
+	t.sequences[string(bucket)] = seq
+	return seq, nil
+}
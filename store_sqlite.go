@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Keeps everything on a SQLite file, which is handy for looking at the cache with other tools.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+type sqlite_tx struct {
+	tx *sql.Tx
+}
+
+const sqlite_schema = `
+CREATE TABLE IF NOT EXISTS kv (
+	bucket TEXT NOT NULL,
+	key    BLOB NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY(bucket, key)
+);
+CREATE TABLE IF NOT EXISTS sequences (
+	bucket TEXT NOT NULL PRIMARY KEY,
+	value  INTEGER NOT NULL
+);`
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqlite_schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) View(fn func(tx StoreTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(sqlite_tx{tx})
+}
+
+func (s *SQLiteStore) Update(fn func(tx StoreTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(sqlite_tx{tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (t sqlite_tx) Get(bucket, key []byte) []byte {
+	var val []byte
+	err := t.tx.QueryRow("SELECT value FROM kv WHERE bucket = ? AND key = ?", string(bucket), key).Scan(&val)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			Log.ErrorF("Failed to read %s from SQLite: %v", key, err)
+		}
+		return nil
+	}
+	if val == nil {
+		val = []byte{}
+	}
+	return val
+}
+
+func (t sqlite_tx) Put(bucket, key, val []byte) error {
+	if val == nil {
+		val = []byte{}
+	}
+	_, err := t.tx.Exec("INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, ?)", string(bucket), key, val)
+	return err
+}
+
+func (t sqlite_tx) Delete(bucket, key []byte) error {
+	_, err := t.tx.Exec("DELETE FROM kv WHERE bucket = ? AND key = ?", string(bucket), key)
+	return err
+}
+
+func (t sqlite_tx) ForEach(bucket, prefix []byte, fn func(key, val []byte) error) error {
+	// A nil []byte is bound as NULL and nothing is >= NULL
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	// Read everything first as fn may write to the same transaction
+	rows, err := t.tx.Query("SELECT key, value FROM kv WHERE bucket = ? AND key >= ? ORDER BY key", string(bucket), prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([][]byte, 0)
+	vals := make([][]byte, 0)
+	for rows.Next() {
+		var key, val []byte
+		if err := rows.Scan(&key, &val); err != nil {
+			rows.Close()
+			return err
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+		vals = append(vals, val)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range keys {
+		if err := fn(keys[i], vals[i]); err == ErrStoreStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t sqlite_tx) NextSequence(bucket []byte) (uint64, error) {
+	var seq uint64
+	err := t.tx.QueryRow("SELECT value FROM sequences WHERE bucket = ?", string(bucket)).Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	seq++
+	_, err = t.tx.Exec("INSERT OR REPLACE INTO sequences (bucket, value) VALUES (?, ?)", string(bucket), seq)
+	return seq, err
+}
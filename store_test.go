@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// Runs fn against every kind of MetadataStore.
+func for_each_store(t *testing.T, fn func(t *testing.T, s MetadataStore)) {
+	stores := map[string]func(dir string) (MetadataStore, error){
+		"memory": func(dir string) (MetadataStore, error) { return NewMemoryStore(), nil },
+		"bolt":   func(dir string) (MetadataStore, error) { return NewBoltStore(filepath.Join(dir, "bolt.db")) },
+		"sqlite": func(dir string) (MetadataStore, error) { return NewSQLiteStore(filepath.Join(dir, "cache.sqlite")) },
+	}
+	for _, kind := range []string{"memory", "bolt", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			s, err := stores[kind](t.TempDir())
+			if err != nil {
+				t.Fatalf("Failed to open store: %v", err)
+			}
+			defer s.Close()
+			fn(t, s)
+		})
+	}
+}
+
+func store_keys(t *testing.T, s MetadataStore, prefix []byte) []string {
+	keys := make([]string, 0)
+	err := s.View(func(tx StoreTx) error {
+		return tx.ForEach(JournalBucket, prefix, func(k, v []byte) error {
+			if string(v) != "v"+string(k) {
+				return fmt.Errorf("%s has %q", k, v)
+			}
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("ForEach(%q) failed: %v", prefix, err)
+	}
+	return keys
+}
+
+func TestStoreForEach(t *testing.T) {
+	for_each_store(t, func(t *testing.T, s MetadataStore) {
+		err := s.Update(func(tx StoreTx) error {
+			for _, k := range []string{"b2", "a", "b1", "c", "ba"} {
+				if err := tx.Put(JournalBucket, []byte(k), []byte("v"+k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		cases := []struct {
+			prefix []byte
+			keys   string
+		}{
+			{nil, "[a b1 b2 ba c]"},
+			{[]byte{}, "[a b1 b2 ba c]"},
+			{[]byte("b"), "[b1 b2 ba]"},
+			{[]byte("b2"), "[b2]"},
+			{[]byte("bb"), "[]"},
+			{[]byte("d"), "[]"},
+		}
+		for _, c := range cases {
+			if keys := fmt.Sprint(store_keys(t, s, c.prefix)); keys != c.keys {
+				t.Errorf("ForEach(%q) returned %s instead of %s", c.prefix, keys, c.keys)
+			}
+		}
+	})
+}
+
+func TestStoreForEachStop(t *testing.T) {
+	for_each_store(t, func(t *testing.T, s MetadataStore) {
+		s.Update(func(tx StoreTx) error {
+			tx.Put(JournalBucket, []byte("a"), []byte("va"))
+			return tx.Put(JournalBucket, []byte("b"), []byte("vb"))
+		})
+		count := 0
+		err := s.View(func(tx StoreTx) error {
+			return tx.ForEach(JournalBucket, nil, func(k, v []byte) error {
+				count++
+				return ErrStoreStop
+			})
+		})
+		if err != nil || count != 1 {
+			t.Errorf("ForEach returned %v after %d calls instead of nil after 1", err, count)
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	for_each_store(t, func(t *testing.T, s MetadataStore) {
+		s.Update(func(tx StoreTx) error {
+			return tx.Put(JournalBucket, []byte("a"), []byte("va"))
+		})
+		// A failed Update changes nothing
+		s.Update(func(tx StoreTx) error {
+			tx.Delete(JournalBucket, []byte("a"))
+			tx.Put(JournalBucket, []byte("b"), []byte("vb"))
+			return fmt.Errorf("fail")
+		})
+		if keys := fmt.Sprint(store_keys(t, s, nil)); keys != "[a]" {
+			t.Errorf("Got %s instead of [a] after a failed Update", keys)
+		}
+		// Keys written in the same transaction are seen by ForEach
+		err := s.Update(func(tx StoreTx) error {
+			tx.Put(JournalBucket, []byte("b"), []byte("vb"))
+			keys := make([][]byte, 0)
+			err := tx.ForEach(JournalBucket, nil, func(k, v []byte) error {
+				keys = append(keys, append([]byte{}, k...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(keys) != 2 {
+				t.Errorf("ForEach returned %d keys instead of 2 inside Update", len(keys))
+			}
+			for _, key := range keys {
+				if err := tx.Delete(JournalBucket, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if keys := fmt.Sprint(store_keys(t, s, nil)); keys != "[]" {
+			t.Errorf("Got %s instead of [] after deleting everything", keys)
+		}
+	})
+}
+
+func TestStoreNextSequence(t *testing.T) {
+	for_each_store(t, func(t *testing.T, s MetadataStore) {
+		last := uint64(0)
+		for i := 0; i < 3; i++ {
+			err := s.Update(func(tx StoreTx) error {
+				seq, err := tx.NextSequence(JournalBucket)
+				if err != nil {
+					return err
+				}
+				if seq <= last {
+					t.Errorf("NextSequence returned %d after %d", seq, last)
+				}
+				last = seq
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("NextSequence failed: %v", err)
+			}
+		}
+	})
+}